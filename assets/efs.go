@@ -4,5 +4,5 @@ import (
 	"embed"
 )
 
-//go:embed "migrations"
+//go:embed "emails" "migrations"
 var EmbeddedFiles embed.FS
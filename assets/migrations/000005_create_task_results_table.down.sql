@@ -0,0 +1 @@
+DROP TABLE IF EXISTS task_results;
\ No newline at end of file
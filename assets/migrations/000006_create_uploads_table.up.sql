@@ -0,0 +1,7 @@
+CREATE TABLE uploads (
+    id TEXT NOT NULL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    content_type TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
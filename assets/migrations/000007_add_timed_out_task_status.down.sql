@@ -0,0 +1,15 @@
+UPDATE tasks SET status = 'failed' WHERE status = 'timed_out';
+
+ALTER TYPE task_status RENAME TO task_status_old;
+CREATE TYPE task_status AS ENUM (
+    'queued',
+    'in_progress',
+    'completed',
+    'failed'
+);
+
+ALTER TABLE tasks ALTER COLUMN status DROP DEFAULT;
+ALTER TABLE tasks ALTER COLUMN status TYPE task_status USING status::text::task_status;
+ALTER TABLE tasks ALTER COLUMN status SET DEFAULT 'queued';
+
+DROP TYPE task_status_old;
@@ -0,0 +1 @@
+ALTER TYPE task_status ADD VALUE IF NOT EXISTS 'timed_out';
@@ -0,0 +1,2 @@
+ALTER TABLE tasks DROP COLUMN IF EXISTS progress_phase;
+ALTER TABLE tasks DROP COLUMN IF EXISTS progress;
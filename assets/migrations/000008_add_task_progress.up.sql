@@ -0,0 +1,2 @@
+ALTER TABLE tasks ADD COLUMN progress INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE tasks ADD COLUMN progress_phase TEXT NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN plan TEXT NOT NULL DEFAULT 'free';
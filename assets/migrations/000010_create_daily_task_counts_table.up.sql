@@ -0,0 +1,14 @@
+-- tasks created per owner and day, kept when the tasks are deleted so
+-- deleting tasks doesn't give back daily quota
+CREATE TABLE daily_task_counts (
+    owner TEXT NOT NULL,
+    day DATE NOT NULL,
+    tasks INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (owner, day)
+);
+
+-- matches usageOwner
+INSERT INTO daily_task_counts (owner, day, tasks)
+SELECT 'user:' || user_id, (created_at AT TIME ZONE 'UTC')::date, COUNT(*)
+FROM tasks
+GROUP BY 1, 2;
@@ -0,0 +1,16 @@
+CREATE TABLE refresh_tokens (
+    id SERIAL NOT NULL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    family_id TEXT NOT NULL,
+    token_hash BYTEA NOT NULL UNIQUE,
+    expires_at timestamp(0) with time zone NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    revoked_at timestamp(0) with time zone
+);
+
+CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens (family_id);
+
+CREATE TABLE revoked_access_tokens (
+    jti TEXT NOT NULL PRIMARY KEY,
+    expires_at timestamp(0) with time zone NOT NULL
+);
@@ -0,0 +1,3 @@
+ALTER TABLE tasks DROP COLUMN IF EXISTS organisation_id;
+DROP TABLE IF EXISTS memberships;
+DROP TABLE IF EXISTS organisations;
\ No newline at end of file
@@ -0,0 +1,20 @@
+CREATE TABLE organisations (
+    id SERIAL NOT NULL PRIMARY KEY,
+    name TEXT NOT NULL,
+    plan TEXT NOT NULL DEFAULT 'free',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE memberships (
+    organisation_id INTEGER NOT NULL REFERENCES organisations(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role TEXT NOT NULL DEFAULT 'member',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (organisation_id, user_id)
+);
+
+CREATE INDEX memberships_user_id_idx ON memberships (user_id);
+
+ALTER TABLE tasks ADD COLUMN organisation_id INTEGER REFERENCES organisations(id) ON DELETE CASCADE;
+
+CREATE INDEX tasks_organisation_id_idx ON tasks (organisation_id);
@@ -0,0 +1,19 @@
+ALTER TABLE users ADD COLUMN activated BOOLEAN NOT NULL DEFAULT false;
+
+-- only accounts created from now on have to verify their email address
+UPDATE users SET activated = true;
+
+-- access tokens issued before the password last changed are rejected, so a
+-- password reset locks out whoever stole a session. timestamp(6) because
+-- tokens issued in the same second as a change may be newer.
+ALTER TABLE users ADD COLUMN password_changed_at timestamp(6) with time zone;
+
+CREATE TABLE user_tokens (
+    token_hash BYTEA NOT NULL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    scope TEXT NOT NULL,
+    expires_at timestamp(0) with time zone NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX user_tokens_user_id_idx ON user_tokens (user_id);
@@ -0,0 +1,22 @@
+CREATE TABLE user_identities (
+    id SERIAL NOT NULL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    issuer TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    email TEXT NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    UNIQUE (issuer, subject)
+);
+
+CREATE INDEX user_identities_user_id_idx ON user_identities (user_id);
+
+-- a login started to link an identity can only complete for the user who
+-- started it, and never as a login
+CREATE TABLE oidc_logins (
+    state_hash BYTEA NOT NULL PRIMARY KEY,
+    code_verifier TEXT NOT NULL,
+    nonce TEXT NOT NULL,
+    purpose TEXT NOT NULL DEFAULT 'login' CHECK (purpose IN ('login', 'link')),
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    expires_at timestamp(0) with time zone NOT NULL
+);
@@ -0,0 +1,26 @@
+CREATE TABLE audit_events (
+    id BIGSERIAL NOT NULL PRIMARY KEY,
+    actor_id INTEGER,
+    api_key_id INTEGER,
+    action TEXT NOT NULL,
+    target_type TEXT NOT NULL DEFAULT '',
+    target_id TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    request_id TEXT NOT NULL DEFAULT '',
+    details JSONB NOT NULL DEFAULT '{}',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX audit_events_created_at_idx ON audit_events (created_at);
+CREATE INDEX audit_events_actor_id_idx ON audit_events (actor_id);
+CREATE INDEX audit_events_target_idx ON audit_events (target_type, target_id);
+
+-- actors are deliberately not foreign keys, events outlive deleted users
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS TRIGGER AS $$ BEGIN RAISE EXCEPTION 'audit_events is append-only';
+END;
+
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_events_append_only BEFORE
+UPDATE OR DELETE ON audit_events FOR EACH ROW EXECUTE FUNCTION audit_events_append_only();
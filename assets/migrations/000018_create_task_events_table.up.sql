@@ -0,0 +1,15 @@
+CREATE TABLE task_events (
+    id BIGSERIAL NOT NULL PRIMARY KEY,
+    task_id INTEGER NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+    type TEXT NOT NULL CHECK (type IN ('queued', 'started', 'retrying', 'completed', 'failed', 'timed_out')),
+    worker TEXT NOT NULL DEFAULT '',
+    attempt INTEGER NOT NULL DEFAULT 0,
+    details TEXT NOT NULL DEFAULT '',
+    created_at timestamp(6) with time zone NOT NULL DEFAULT clock_timestamp()
+);
+
+CREATE INDEX task_events_task_id_idx ON task_events (task_id, id);
+
+-- tasks queued before events were recorded get their creation as history
+INSERT INTO task_events (task_id, type, created_at)
+SELECT id, 'queued', created_at FROM tasks;
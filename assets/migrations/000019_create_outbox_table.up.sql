@@ -0,0 +1,15 @@
+CREATE TABLE outbox (
+    id BIGSERIAL NOT NULL PRIMARY KEY,
+    type TEXT NOT NULL,
+    payload BYTEA NOT NULL,
+    queue TEXT NOT NULL,
+    max_retry INTEGER NOT NULL DEFAULT 0,
+    timeout INTEGER NOT NULL DEFAULT 0,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT '',
+    available_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    sent_at timestamp(0) with time zone
+);
+
+CREATE INDEX outbox_unsent_idx ON outbox (available_at) WHERE sent_at IS NULL;
@@ -0,0 +1,3 @@
+ALTER TABLE outbox ADD COLUMN key TEXT NOT NULL DEFAULT '';
+
+CREATE INDEX outbox_unsent_key_idx ON outbox (key) WHERE sent_at IS NULL;
@@ -0,0 +1,3 @@
+-- unlike the version of users this isn't bumped by a trigger, so progress
+-- reports don't conflict with the worker's own status updates
+ALTER TABLE tasks ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
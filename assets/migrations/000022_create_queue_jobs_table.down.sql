@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS queue_jobs;
+DROP FUNCTION IF EXISTS queue_jobs_notify;
+ALTER TABLE outbox DROP COLUMN IF EXISTS group_key;
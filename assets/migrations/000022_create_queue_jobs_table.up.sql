@@ -0,0 +1,39 @@
+ALTER TABLE outbox ADD COLUMN group_key TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE queue_jobs (
+    id BIGSERIAL NOT NULL PRIMARY KEY,
+    key TEXT NOT NULL DEFAULT '',
+    type TEXT NOT NULL,
+    payload BYTEA NOT NULL,
+    queue TEXT NOT NULL,
+    group_key TEXT NOT NULL DEFAULT '',
+    max_retry INTEGER NOT NULL DEFAULT 0,
+    timeout INTEGER NOT NULL DEFAULT 0,
+    retried INTEGER NOT NULL DEFAULT 0,
+    state TEXT NOT NULL DEFAULT 'pending' CHECK (state IN ('pending', 'active', 'archived')),
+    last_error TEXT NOT NULL DEFAULT '',
+    -- timestamp(6) so jobs due now aren't rounded up into the future, where
+    -- workers woken up for them can't claim them yet
+    run_at timestamp(6) with time zone NOT NULL DEFAULT NOW(),
+    leased_by TEXT NOT NULL DEFAULT '',
+    leased_until timestamp(6) with time zone,
+    -- archived jobs are deleted once they have been kept for the retention
+    archived_at timestamp(0) with time zone,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+-- like asynq's task IDs, a key is only rejected while a job holds it
+CREATE UNIQUE INDEX queue_jobs_key_idx ON queue_jobs (key) WHERE key <> '';
+CREATE INDEX queue_jobs_pending_idx ON queue_jobs (queue, run_at, id) WHERE state = 'pending';
+CREATE INDEX queue_jobs_active_idx ON queue_jobs (group_key, leased_until) WHERE state = 'active';
+CREATE INDEX queue_jobs_archived_idx ON queue_jobs (archived_at) WHERE state = 'archived';
+
+-- wakes idle workers up once the transaction enqueueing a job commits
+CREATE OR REPLACE FUNCTION queue_jobs_notify() RETURNS TRIGGER AS $$ BEGIN PERFORM pg_notify('queue_jobs', NEW.queue);
+RETURN NULL;
+END;
+
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER queue_jobs_notify AFTER
+INSERT ON queue_jobs FOR EACH ROW EXECUTE FUNCTION queue_jobs_notify();
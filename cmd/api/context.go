@@ -5,12 +5,17 @@ import (
 	"net/http"
 
 	"github.com/Babatunde50/distributask/internal/database"
+	"github.com/pascaldekloe/jwt"
 )
 
 type contextKey string
 
 const (
 	authenticatedUserContextKey = contextKey("authenticatedUser")
+	accessTokenContextKey       = contextKey("accessToken")
+	apiKeyContextKey            = contextKey("apiKey")
+	permissionsContextKey       = contextKey("permissions")
+	requestIDContextKey         = contextKey("requestID")
 )
 
 func contextSetAuthenticatedUser(r *http.Request, user *database.User) *http.Request {
@@ -26,3 +31,51 @@ func contextGetAuthenticatedUser(r *http.Request) *database.User {
 
 	return user
 }
+
+func contextSetAccessToken(r *http.Request, claims *jwt.Claims) *http.Request {
+	ctx := context.WithValue(r.Context(), accessTokenContextKey, claims)
+	return r.WithContext(ctx)
+}
+
+func contextGetAccessToken(r *http.Request) *jwt.Claims {
+	claims, ok := r.Context().Value(accessTokenContextKey).(*jwt.Claims)
+	if !ok {
+		return nil
+	}
+
+	return claims
+}
+
+func contextSetAPIKey(r *http.Request, key *database.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+func contextGetAPIKey(r *http.Request) *database.APIKey {
+	key, ok := r.Context().Value(apiKeyContextKey).(*database.APIKey)
+	if !ok {
+		return nil
+	}
+
+	return key
+}
+
+func contextSetPermissions(r *http.Request, permissions []string) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionsContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+func contextGetPermissions(r *http.Request) []string {
+	permissions, _ := r.Context().Value(permissionsContextKey).([]string)
+	return permissions
+}
+
+func contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+func contextGetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
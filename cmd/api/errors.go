@@ -2,9 +2,12 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
 	"runtime/debug"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Babatunde50/distributask/internal/response"
 	"github.com/Babatunde50/distributask/internal/validator"
@@ -65,3 +68,38 @@ func (app *application) invalidAuthenticationToken(w http.ResponseWriter, r *htt
 func (app *application) authenticationRequired(w http.ResponseWriter, r *http.Request) {
 	app.errorMessage(w, r, http.StatusUnauthorized, "You must be authenticated to access this resource", nil)
 }
+
+func (app *application) rateLimitExceeded(w http.ResponseWriter, r *http.Request, headers http.Header) {
+	app.errorMessage(w, r, http.StatusTooManyRequests, "Rate limit exceeded", headers)
+}
+
+func (app *application) quotaExceeded(w http.ResponseWriter, r *http.Request, status int, message string) {
+	app.errorMessage(w, r, status, message, nil)
+}
+
+func (app *application) invalidRefreshToken(w http.ResponseWriter, r *http.Request) {
+	app.errorMessage(w, r, http.StatusUnauthorized, "Invalid or expired refresh token", nil)
+}
+
+func (app *application) notPermitted(w http.ResponseWriter, r *http.Request) {
+	app.errorMessage(w, r, http.StatusForbidden, "You don't have permission to access this resource", nil)
+}
+
+func (app *application) inactiveAccount(w http.ResponseWriter, r *http.Request) {
+	app.errorMessage(w, r, http.StatusForbidden, "Your account must be activated to access this resource", nil)
+}
+
+func (app *application) editConflict(w http.ResponseWriter, r *http.Request) {
+	app.errorMessage(w, r, http.StatusConflict, "Unable to update the record due to an edit conflict, please try again", nil)
+}
+
+func (app *application) invalidCredentials(w http.ResponseWriter, r *http.Request) {
+	app.errorMessage(w, r, http.StatusUnauthorized, "Invalid email or password", nil)
+}
+
+func (app *application) tooManyLoginAttempts(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	headers := make(http.Header)
+	headers.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+
+	app.errorMessage(w, r, http.StatusTooManyRequests, "Too many failed login attempts, please try again later", headers)
+}
@@ -2,23 +2,28 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Babatunde50/distributask/internal/database"
+	"github.com/Babatunde50/distributask/internal/oidc"
 	"github.com/Babatunde50/distributask/internal/password"
 	"github.com/Babatunde50/distributask/internal/request"
 	"github.com/Babatunde50/distributask/internal/response"
+	"github.com/Babatunde50/distributask/internal/storage"
+	"github.com/Babatunde50/distributask/internal/token"
 	"github.com/Babatunde50/distributask/internal/validator"
 	"github.com/Babatunde50/distributask/internal/worker"
 	"github.com/go-chi/chi/v5"
-	"github.com/hibiken/asynq"
 
 	"net/url"
-
-	"github.com/pascaldekloe/jwt"
 )
 
 func (app *application) status(w http.ResponseWriter, r *http.Request) {
@@ -32,6 +37,18 @@ func (app *application) status(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// jwks publishes the public keys access tokens are signed with, so other
+// services can check them without sharing a secret.
+func (app *application) jwks(w http.ResponseWriter, r *http.Request) {
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "public, max-age=300")
+
+	err := app.writeJSON(w, http.StatusOK, app.keys.JWKS(), headers)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
 func (app *application) createUser(w http.ResponseWriter, r *http.Request) {
 	var input struct {
 		Email     string              `json:"email"`
@@ -45,7 +62,7 @@ func (app *application) createUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	existingUser, err := app.db.GetUserByEmail(input.Email)
+	existingUser, err := app.db.GetUserByEmail(r.Context(), input.Email)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
@@ -73,13 +90,26 @@ func (app *application) createUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = app.db.InsertUser(input.Email, hashedPassword)
+	id, err := app.db.InsertUser(r.Context(), input.Email, hashedPassword)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	// the account exists either way, a new activation token can be requested
+	// if this email never arrives
+	err = app.sendUserToken(r.Context(), &database.User{ID: id, Email: input.Email}, database.UserTokenScopeActivation, activationTokenTTL, "user_welcome.tmpl", "activationToken")
+	if err != nil {
+		app.reportError(err)
+	}
+
+	user, err := app.db.GetUser(r.Context(), id)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, input, nil)
+	err = app.writeJSON(w, http.StatusCreated, user, nil)
 
 	if err != nil {
 		app.serverError(w, r, err)
@@ -87,186 +117,333 @@ func (app *application) createUser(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func (app *application) listTasks(w http.ResponseWriter, r *http.Request) {
+func (app *application) activateUser(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Page     int    `json:"page"`
-		PageSize int    `json:"page_size"`
-		Sort     string `json:"sort"`
+		Token     string              `json:"token"`
+		Validator validator.Validator `json:"-"`
 	}
 
-	qs := r.URL.Query()
+	err := request.DecodeJSON(w, r, &input)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
 
-	input.Page = app.readInt(qs, "page", 1)
-	input.PageSize = app.readInt(qs, "page_size", 10)
-	input.Sort = app.readString(qs, "sort", "id")
+	input.Validator.CheckField(input.Token != "", "Token", "Token is required")
 
-	authenticatedUser := contextGetAuthenticatedUser(r)
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	user, err := app.db.ConsumeUserToken(r.Context(), token.Hash(input.Token), database.UserTokenScopeActivation)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	input.Validator.CheckField(user != nil, "Token", "Invalid or expired activation token")
 
-	tasks, err := app.db.ListTasks(authenticatedUser.ID, database.Filters{Page: input.Page, PageSize: input.PageSize})
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
 
+	err = app.db.ActivateUser(r.Context(), user.ID)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, tasks, nil)
+	err = app.db.DeleteUserTokens(r.Context(), user.ID, database.UserTokenScopeActivation)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, map[string]string{"message": "Your account has been activated"}, nil)
 
 	if err != nil {
 		app.serverError(w, r, err)
 	}
+}
+
+// createActivationToken sends a new activation token to a user who has not
+// activated their account yet.
+func (app *application) createActivationToken(w http.ResponseWriter, r *http.Request) {
+	app.sendEmailToken(w, r, func(user *database.User) error {
+		if user.Activated {
+			return nil
+		}
 
+		return app.sendUserToken(r.Context(), user, database.UserTokenScopeActivation, activationTokenTTL, "user_welcome.tmpl", "activationToken")
+	})
 }
 
-func (app *application) deleteTask(w http.ResponseWriter, r *http.Request) {
+func (app *application) createPasswordResetToken(w http.ResponseWriter, r *http.Request) {
+	app.sendEmailToken(w, r, func(user *database.User) error {
+		err := app.db.DeleteUserTokens(r.Context(), user.ID, database.UserTokenScopePasswordReset)
+		if err != nil {
+			return err
+		}
 
-	taskIdInt, err := strconv.Atoi(chi.URLParam(r, "taskID"))
+		return app.sendUserToken(r.Context(), user, database.UserTokenScopePasswordReset, passwordResetTokenTTL, "password_reset.tmpl", "passwordResetToken")
+	})
+}
+
+// sendEmailToken reads an email address and calls send with its user, if any.
+// The response is the same whether the user exists or not, so it can't be used
+// to find out who has an account.
+func (app *application) sendEmailToken(w http.ResponseWriter, r *http.Request, send func(user *database.User) error) {
+	var input struct {
+		Email     string              `json:"email"`
+		Validator validator.Validator `json:"-"`
+	}
 
+	err := request.DecodeJSON(w, r, &input)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
-	authenticatedUser := contextGetAuthenticatedUser(r)
+	input.Validator.CheckField(input.Email != "", "Email", "Email is required")
+	input.Validator.CheckField(validator.Matches(input.Email, validator.RgxEmail), "Email", "Must be a valid email address")
 
-	err = app.db.DeleteTask(taskIdInt, authenticatedUser.ID)
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
 
+	user, err := app.db.GetUserByEmail(r.Context(), input.Email)
 	if err != nil {
-		app.badRequest(w, r, err)
+		app.serverError(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusNoContent, nil, nil)
+	if user != nil {
+		err = send(user)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, map[string]string{"message": "If an account with this email exists, an email with further instructions will be sent to it shortly"}, nil)
 
 	if err != nil {
 		app.serverError(w, r, err)
 	}
-
 }
 
-func (app *application) getTask(w http.ResponseWriter, r *http.Request) {
-
-	taskIdInt, err := strconv.Atoi(chi.URLParam(r, "taskID"))
+// resetPassword sets a new password using a password reset token, and signs
+// the user out of every session. Getting the token by email also proves the
+// user owns the address, so the account is activated too.
+func (app *application) resetPassword(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password  string              `json:"password"`
+		Token     string              `json:"token"`
+		Validator validator.Validator `json:"-"`
+	}
 
+	err := request.DecodeJSON(w, r, &input)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
-	authenticatedUser := contextGetAuthenticatedUser(r)
+	input.Validator.CheckField(input.Token != "", "Token", "Token is required")
+
+	input.Validator.CheckField(input.Password != "", "Password", "Password is required")
+	input.Validator.CheckField(len(input.Password) >= 8, "Password", "Password is too short")
+	input.Validator.CheckField(len(input.Password) <= 72, "Password", "Password is too long")
+	input.Validator.CheckField(validator.NotIn(input.Password, password.CommonPasswords...), "Password", "Password is too common")
 
-	task, err := app.db.GetTask(taskIdInt, authenticatedUser.ID)
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
 
+	user, err := app.db.ConsumeUserToken(r.Context(), token.Hash(input.Token), database.UserTokenScopePasswordReset)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, task, nil)
+	input.Validator.CheckField(user != nil, "Token", "Invalid or expired password reset token")
 
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	hashedPassword, err := password.Hash(input.Password)
 	if err != nil {
 		app.serverError(w, r, err)
+		return
 	}
-}
 
-func isImageURL(path string) bool {
-	parsedURL, err := url.Parse(path)
+	err = app.db.UpdateUserHashedPassword(r.Context(), user.ID, hashedPassword)
 	if err != nil {
-		return false
+		app.serverError(w, r, err)
+		return
 	}
-	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
-		return false
+
+	err = app.db.ActivateUser(r.Context(), user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
 	}
-	if !strings.HasSuffix(parsedURL.Path, ".jpeg") && !strings.HasSuffix(parsedURL.Path, ".jpg") &&
-		!strings.HasSuffix(parsedURL.Path, ".png") && !strings.HasSuffix(parsedURL.Path, ".gif") {
-		return false
+
+	err = app.db.DeleteUserTokens(r.Context(), user.ID, database.UserTokenScopePasswordReset)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.db.RevokeUserRefreshTokens(r.Context(), user.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.audit(r, database.AuditEvent{ActorID: &user.ID, Action: database.AuditPasswordReset, TargetType: "user", TargetID: strconv.Itoa(user.ID)})
+
+	// the owner of the account can log in again right away
+	err = app.loginAccounts.Reset(r.Context(), "login:email:"+strings.ToLower(user.Email))
+	if err != nil {
+		app.reportError(err)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, map[string]string{"message": "Your password has been reset"}, nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
 	}
-	return true
 }
 
-func (app *application) createTask(w http.ResponseWriter, r *http.Request) {
+func (app *application) getMe(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, contextGetAuthenticatedUser(r), nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
 
+// updateMe changes the email or password of the authenticated user. Both need
+// the current password, and the version the client last read must still be
+// current if it is given. A new email has to be activated again.
+func (app *application) updateMe(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Type      string                     `json:"type"`
-		Payload   database.Payload           `json:"payload"`
-		Params    database.AllPossibleParams `json:"params"`
-		Validator validator.Validator        `json:"-"`
+		Email           *string             `json:"email"`
+		Password        *string             `json:"password"`
+		CurrentPassword string              `json:"current_password"`
+		Version         *int                `json:"version"`
+		Validator       validator.Validator `json:"-"`
 	}
 
 	err := request.DecodeJSON(w, r, &input)
-
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
 
-	// validate type
-	input.Validator.CheckField(input.Type == "image_processing", "Type", "only image_processing type is allowed")
-
-	// validate payload
-	input.Validator.CheckField(isImageURL(input.Payload.URL), "Payload", "Provide a valid image url")
-	input.Validator.CheckField(input.Payload.Operation == database.Resize || input.Payload.Operation == database.Crop || input.Payload.Operation == database.Rotate || input.Payload.Operation == database.Flip, "Payload", "Provide a valid operation to perform on the image")
+	user := *contextGetAuthenticatedUser(r)
 
-	if input.Validator.HasErrors() {
-		app.failedValidation(w, r, input.Validator)
+	if input.Version != nil && *input.Version != user.Version {
+		app.editConflict(w, r)
 		return
 	}
 
-	err = input.Payload.UpdateParams(input.Payload.Operation, input.Params)
-
+	passwordMatches, err := password.Matches(input.CurrentPassword, user.PasswordHash)
 	if err != nil {
-		app.badRequest(w, r, err)
+		app.serverError(w, r, err)
+		return
 	}
 
-	authenticatedUser := contextGetAuthenticatedUser(r)
+	input.Validator.CheckField(passwordMatches, "CurrentPassword", "Current password is incorrect")
 
-	// TODO: remove hardcoded values
-	task := database.Task{
-		Type:       input.Type,
-		Payload:    input.Payload,
-		Priority:   2,
-		Timeout:    30,
-		MaxRetries: 5,
-		UserId:     authenticatedUser.ID,
+	emailChanged := input.Email != nil && *input.Email != user.Email
+
+	if emailChanged {
+		input.Validator.CheckField(*input.Email != "", "Email", "Email is required")
+		input.Validator.CheckField(validator.Matches(*input.Email, validator.RgxEmail), "Email", "Must be a valid email address")
+
+		user.Email = *input.Email
+		user.Activated = false
 	}
 
-	// insert task and distribute task to worker node..
-	err = app.db.InsertTask(&task, func(createdTask *database.Task) error {
-		ctx, cancel := context.WithTimeout(context.Background(), 4000)
-		defer cancel()
+	if input.Password != nil {
+		input.Validator.CheckField(*input.Password != "", "Password", "Password is required")
+		input.Validator.CheckField(len(*input.Password) >= 8, "Password", "Password is too short")
+		input.Validator.CheckField(len(*input.Password) <= 72, "Password", "Password is too long")
+		input.Validator.CheckField(validator.NotIn(*input.Password, password.CommonPasswords...), "Password", "Password is too common")
+	}
 
-		err = app.taskDistributor.DistributeTaskSendTask(ctx, &worker.PayloadSendTask{
-			TaskID: createdTask.ID,
-			UserID: createdTask.UserId,
-		}, asynq.MaxRetry(createdTask.MaxRetries), asynq.Timeout(time.Duration(createdTask.Timeout)*time.Second))
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
 
+	if input.Password != nil {
+		user.PasswordHash, err = password.Hash(*input.Password)
 		if err != nil {
-			return err
+			app.serverError(w, r, err)
+			return
 		}
+	}
 
-		return nil
-	})
-
+	err = app.db.UpdateUser(r.Context(), &user)
 	if err != nil {
-		app.serverError(w, r, err)
+		switch {
+		case errors.Is(err, database.ErrEditConflict):
+			app.editConflict(w, r)
+		case errors.Is(err, database.ErrDuplicateEmail):
+			input.Validator.AddFieldError("Email", "Email is already in use")
+			app.failedValidation(w, r, input.Validator)
+		default:
+			app.serverError(w, r, err)
+		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, struct {
-		Message string
-		Url     string
-	}{Message: "Task is now being processed", Url: app.config.baseURL + "/tasks/" + strconv.Itoa(task.ID)}, nil)
+	// other sessions were opened with the old password
+	if input.Password != nil {
+		err = app.db.RevokeUserRefreshTokens(r.Context(), user.ID)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	app.audit(r, database.AuditEvent{Action: database.AuditUserUpdated, TargetType: "user", TargetID: strconv.Itoa(user.ID), Details: database.AuditDetails{"email_changed": emailChanged, "password_changed": input.Password != nil}})
+
+	if emailChanged {
+		err = app.db.DeleteUserTokens(r.Context(), user.ID, database.UserTokenScopeActivation)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		err = app.sendUserToken(r.Context(), &user, database.UserTokenScopeActivation, activationTokenTTL, "user_welcome.tmpl", "activationToken")
+		if err != nil {
+			app.reportError(err)
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, user, nil)
 
 	if err != nil {
 		app.serverError(w, r, err)
-		return
 	}
 }
 
-func (app *application) createAuthenticationToken(w http.ResponseWriter, r *http.Request) {
+// deleteMe deletes the authenticated user's account with all of their tasks,
+// results and uploads. Users who are the only owner of an organisation with
+// other members have to hand it over first.
+func (app *application) deleteMe(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Email     string              `json:"email"`
-		Password  string              `json:"password"`
-		Validator validator.Validator `json:"-"`
+		CurrentPassword string              `json:"current_password"`
+		Validator       validator.Validator `json:"-"`
 	}
 
 	err := request.DecodeJSON(w, r, &input)
@@ -275,55 +452,1700 @@ func (app *application) createAuthenticationToken(w http.ResponseWriter, r *http
 		return
 	}
 
-	user, err := app.db.GetUserByEmail(input.Email)
+	authenticatedUser := contextGetAuthenticatedUser(r)
+
+	passwordMatches, err := password.Matches(input.CurrentPassword, authenticatedUser.PasswordHash)
 	if err != nil {
 		app.serverError(w, r, err)
 		return
 	}
 
-	input.Validator.CheckField(input.Email != "", "Email", "Email is required")
-	input.Validator.CheckField(user != nil, "Email", "Email address could not be found")
+	input.Validator.CheckField(passwordMatches, "CurrentPassword", "Current password is incorrect")
 
-	if user != nil {
-		passwordMatches, err := password.Matches(input.Password, user.PasswordHash)
-		if err != nil {
-			app.serverError(w, r, err)
-			return
-		}
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
 
-		input.Validator.CheckField(input.Password != "", "Password", "Password is required")
-		input.Validator.CheckField(passwordMatches, "Password", "Password is incorrect")
+	soleOwnerships, err := app.db.CountSoleOwnerships(r.Context(), authenticatedUser.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
 	}
 
-	if input.Validator.HasErrors() {
-		app.failedValidation(w, r, input.Validator)
+	if soleOwnerships > 0 {
+		app.errorMessage(w, r, http.StatusConflict, "You are the only owner of an organisation with other members, make somebody else an owner first", nil)
+		return
+	}
+
+	uploadIDs, err := app.db.DeleteUser(r.Context(), authenticatedUser.ID)
+	if err != nil {
+		app.serverError(w, r, err)
 		return
 	}
 
-	// create JWT
-	var claims jwt.Claims
-	claims.Subject = strconv.Itoa(user.ID)
+	app.audit(r, database.AuditEvent{Action: database.AuditUserDeleted, TargetType: "user", TargetID: strconv.Itoa(authenticatedUser.ID)})
+
+	// the account is gone either way, so images that can't be removed now
+	// are only reported
+	app.backgroundTask(func() error {
+		for _, id := range uploadIDs {
+			err := app.storage.Delete(context.Background(), database.UploadStorageKey(id))
+			if err != nil && !errors.Is(err, storage.ErrNotFound) {
+				return err
+			}
+		}
+		return nil
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	expiry := time.Now().Add(24 * time.Hour)
-	claims.Issued = jwt.NewNumericTime(time.Now())
-	claims.NotBefore = jwt.NewNumericTime(time.Now())
-	claims.Expires = jwt.NewNumericTime(expiry)
+func (app *application) getUsage(w http.ResponseWriter, r *http.Request) {
+	authenticatedUser := contextGetAuthenticatedUser(r)
 
-	claims.Issuer = app.config.baseURL
-	claims.Audiences = []string{app.config.baseURL}
+	usage, err := app.db.GetUsage(r.Context(), authenticatedUser.ID)
 
-	jwtBytes, err := claims.HMACSign(jwt.HS256, []byte(app.config.jwt.secretKey))
 	if err != nil {
 		app.serverError(w, r, err)
 		return
 	}
 
-	data := map[string]string{
-		"AuthenticationToken":       string(jwtBytes),
-		"AuthenticationTokenExpiry": expiry.Format(time.RFC3339),
+	data := map[string]any{
+		"plan":   authenticatedUser.Plan,
+		"usage":  usage,
+		"quotas": app.quotaFor(authenticatedUser.Plan),
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, data, nil)
+	err = app.writeJSON(w, http.StatusOK, data, nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) listTasks(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Page     int    `json:"page"`
+		PageSize int    `json:"page_size"`
+		Sort     string `json:"sort"`
+	}
+
+	qs := r.URL.Query()
+
+	input.Page = app.readInt(qs, "page", 1)
+	input.PageSize = app.readInt(qs, "page_size", 10)
+	input.Sort = app.readString(qs, "sort", "id")
+
+	authenticatedUser := contextGetAuthenticatedUser(r)
+
+	tasks, err := app.db.ListTasks(r.Context(), authenticatedUser.ID, app.readInt(qs, "organisation_id", 0), database.Filters{Page: input.Page, PageSize: input.PageSize})
+
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, tasks, nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+
+}
+
+func (app *application) deleteTask(w http.ResponseWriter, r *http.Request) {
+
+	taskIdInt, err := strconv.Atoi(chi.URLParam(r, "taskID"))
+
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	authenticatedUser := contextGetAuthenticatedUser(r)
+
+	deleted, err := app.db.DeleteTask(r.Context(), taskIdInt, authenticatedUser.ID)
+
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !deleted {
+		app.notFound(w, r)
+		return
+	}
+
+	app.audit(r, database.AuditEvent{Action: database.AuditTaskDeleted, TargetType: "task", TargetID: strconv.Itoa(taskIdInt)})
+
+	err = app.writeJSON(w, http.StatusNoContent, nil, nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+
+}
+
+func (app *application) getTask(w http.ResponseWriter, r *http.Request) {
+
+	taskIdInt, err := strconv.Atoi(chi.URLParam(r, "taskID"))
+
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	authenticatedUser := contextGetAuthenticatedUser(r)
+
+	task, err := app.db.GetTask(r.Context(), taskIdInt, authenticatedUser.ID)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, task, nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// getTaskHistory lists every transition of a task, oldest first, with how
+// long it waited in the queue and how long its last attempt ran.
+func (app *application) getTaskHistory(w http.ResponseWriter, r *http.Request) {
+
+	taskIdInt, err := strconv.Atoi(chi.URLParam(r, "taskID"))
+
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	authenticatedUser := contextGetAuthenticatedUser(r)
+
+	task, err := app.db.GetTask(r.Context(), taskIdInt, authenticatedUser.ID)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	events, err := app.db.ListTaskEvents(r.Context(), task.ID)
+
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	durations := database.Durations(events)
+
+	data := struct {
+		TaskID           int                   `json:"task_id"`
+		Status           string                `json:"status"`
+		QueueWaitSeconds *float64              `json:"queue_wait_seconds"`
+		RunSeconds       *float64              `json:"run_seconds"`
+		Events           []*database.TaskEvent `json:"events"`
+	}{
+		TaskID:           task.ID,
+		Status:           task.Status,
+		QueueWaitSeconds: seconds(durations.QueueWait),
+		RunSeconds:       seconds(durations.Run),
+		Events:           events,
+	}
+
+	err = app.writeJSON(w, http.StatusOK, data, nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) createUpload(w http.ResponseWriter, r *http.Request) {
+	if !isMultipartRequest(r) {
+		app.badRequest(w, r, errors.New("body must be a multipart/form-data request"))
+		return
+	}
+
+	image, contentType, err := app.readImageUpload(w, r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	authenticatedUser := contextGetAuthenticatedUser(r)
+
+	upload, err := app.saveUpload(r.Context(), authenticatedUser.ID, image, contentType)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, upload, nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) listTaskResults(w http.ResponseWriter, r *http.Request) {
+
+	taskIdInt, err := strconv.Atoi(chi.URLParam(r, "taskID"))
+
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	authenticatedUser := contextGetAuthenticatedUser(r)
+
+	task, err := app.db.GetTask(r.Context(), taskIdInt, authenticatedUser.ID)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	results, err := app.db.ListTaskResults(r.Context(), task.ID)
+
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	type variant struct {
+		*database.TaskResult
+		URL string `json:"url"`
+	}
+
+	manifest := make([]variant, len(results))
+
+	for i, result := range results {
+		manifest[i] = variant{
+			TaskResult: result,
+			URL:        app.config.baseURL + "/tasks/" + strconv.Itoa(task.ID) + "/results/" + result.Name,
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, map[string]any{"task_id": task.ID, "results": manifest}, nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) getTaskResult(w http.ResponseWriter, r *http.Request) {
+
+	taskIdInt, err := strconv.Atoi(chi.URLParam(r, "taskID"))
+
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	authenticatedUser := contextGetAuthenticatedUser(r)
+
+	task, err := app.db.GetTask(r.Context(), taskIdInt, authenticatedUser.ID)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	result, err := app.db.GetTaskResult(r.Context(), task.ID, chi.URLParam(r, "name"))
+
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if result == nil {
+		app.notFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", result.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(result.Size))
+	w.WriteHeader(http.StatusOK)
+	w.Write(result.Data)
+}
+
+func isImageURL(path string) bool {
+	parsedURL, err := url.Parse(path)
+	if err != nil {
+		return false
+	}
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return false
+	}
+	if !strings.HasSuffix(parsedURL.Path, ".jpeg") && !strings.HasSuffix(parsedURL.Path, ".jpg") &&
+		!strings.HasSuffix(parsedURL.Path, ".png") && !strings.HasSuffix(parsedURL.Path, ".gif") {
+		return false
+	}
+	return true
+}
+
+func (app *application) createTask(w http.ResponseWriter, r *http.Request) {
+
+	var input struct {
+		Type           string                     `json:"type"`
+		Payload        database.Payload           `json:"payload"`
+		Params         database.AllPossibleParams `json:"params"`
+		Priority       int                        `json:"priority"`
+		OrganisationID *int                       `json:"organisation_id"`
+		Validator      validator.Validator        `json:"-"`
+	}
+
+	authenticatedUser := contextGetAuthenticatedUser(r)
+
+	// multipart requests carry the image itself in the "image" field and
+	// the rest of the task as JSON encoded form values
+	var image []byte
+	var imageContentType string
+	var err error
+
+	if isMultipartRequest(r) {
+		image, imageContentType, err = app.readImageUpload(w, r)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+
+		input.Type = r.FormValue("type")
+
+		if value := r.FormValue("priority"); value != "" {
+			input.Priority, err = strconv.Atoi(value)
+			if err != nil {
+				app.badRequest(w, r, errors.New("form field priority must be an integer"))
+				return
+			}
+		}
+
+		if value := r.FormValue("organisation_id"); value != "" {
+			organisationID, err := strconv.Atoi(value)
+			if err != nil {
+				app.badRequest(w, r, errors.New("form field organisation_id must be an integer"))
+				return
+			}
+			input.OrganisationID = &organisationID
+		}
+
+		for field, dst := range map[string]any{"payload": &input.Payload, "params": &input.Params} {
+			if value := r.FormValue(field); value != "" {
+				err = json.Unmarshal([]byte(value), dst)
+				if err != nil {
+					app.badRequest(w, r, fmt.Errorf("form field %s contains badly-formed JSON", field))
+					return
+				}
+			}
+		}
+	} else {
+		err = request.DecodeJSON(w, r, &input)
+
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+	}
+
+	// validate type
+	input.Validator.CheckField(input.Type == "image_processing", "Type", "only image_processing type is allowed")
+
+	// validate payload
+	switch {
+	case image != nil:
+		input.Validator.CheckField(input.Payload.URL == "" && input.Payload.UploadID == "", "Payload", "Provide either an image file, an image url or an upload id")
+	case input.Payload.UploadID != "":
+		upload, err := app.db.GetUpload(r.Context(), input.Payload.UploadID, authenticatedUser.ID)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		input.Validator.CheckField(input.Payload.URL == "", "Payload", "Provide either an image url or an upload id")
+		input.Validator.CheckField(upload != nil, "Payload", "Upload could not be found")
+	default:
+		input.Validator.CheckField(isImageURL(input.Payload.URL), "Payload", "Provide a valid image url")
+	}
+	// tasks of an organisation are shared with, and count against, all of its members
+	var organisation *database.Organisation
+	if input.OrganisationID != nil {
+		organisation, err = app.memberOrganisation(r.Context(), *input.OrganisationID, authenticatedUser.ID)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		input.Validator.CheckField(organisation != nil, "OrganisationID", "Organisation could not be found")
+	}
+
+	if input.Priority == 0 {
+		input.Priority = database.TaskPriorityDefault
+	}
+
+	input.Validator.CheckField(input.Priority >= database.TaskPriorityLow && input.Priority <= database.TaskPriorityHigh, "Priority", "Priority must be 1 (low), 2 (default) or 3 (high)")
+
+	input.Validator.CheckField(validator.In(input.Payload.Operation, database.Resize, database.Crop, database.Rotate, database.Flip, database.Thumbnails, database.Inspect), "Payload", "Provide a valid operation to perform on the image")
+
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	err = input.Payload.UpdateParams(input.Payload.Operation, input.Params)
+
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	status, message, err := app.checkQuota(r.Context(), authenticatedUser, organisation)
+
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if status != 0 {
+		app.quotaExceeded(w, r, status, message)
+		return
+	}
+
+	if image != nil {
+		upload, err := app.saveUpload(r.Context(), authenticatedUser.ID, image, imageContentType)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		input.Payload.UploadID = upload.ID
+	}
+
+	// TODO: remove hardcoded values
+	task := database.Task{
+		Type:           input.Type,
+		Payload:        input.Payload,
+		Priority:       input.Priority,
+		Timeout:        30,
+		MaxRetries:     5,
+		UserId:         authenticatedUser.ID,
+		OrganisationID: input.OrganisationID,
+	}
+
+	plan := authenticatedUser.Plan
+	if organisation != nil {
+		plan = organisation.Plan
+	}
+
+	q := app.quotaFor(plan)
+
+	// checkQuota only turns most requests over quota away early, InsertTask
+	// enforces the task quotas against concurrent requests. The task is queued
+	// by the outbox relay once it is committed.
+	err = app.db.InsertTask(r.Context(), &task, database.TaskQuota{MaxActiveTasks: q.MaxActiveTasks, MaxDailyTasks: q.MaxDailyTasks}, worker.NewSendTaskMessage)
+
+	var quotaErr *database.QuotaError
+
+	switch {
+	case errors.As(err, &quotaErr):
+		app.quotaExceeded(w, r, http.StatusTooManyRequests, quotaMessage(quotaErr))
+		return
+	case err != nil:
+		app.serverError(w, r, err)
+		return
+	}
+
+	details := database.AuditDetails{"operation": task.Payload.Operation}
+	if task.OrganisationID != nil {
+		details["organisation_id"] = *task.OrganisationID
+	}
+	app.audit(r, database.AuditEvent{Action: database.AuditTaskCreated, TargetType: "task", TargetID: strconv.Itoa(task.ID), Details: details})
+
+	err = app.writeJSON(w, http.StatusCreated, struct {
+		Message string
+		Url     string
+	}{Message: "Task is now being processed", Url: app.config.baseURL + "/tasks/" + strconv.Itoa(task.ID)}, nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+}
+
+// createAuthenticationToken logs a user in with their email and password, or
+// completes an OpenID Connect login with the code and state the provider
+// redirected back with.
+func (app *application) createAuthenticationToken(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email     string              `json:"email"`
+		Password  string              `json:"password"`
+		Code      string              `json:"code"`
+		State     string              `json:"state"`
+		Validator validator.Validator `json:"-"`
+	}
+
+	err := request.DecodeJSON(w, r, &input)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var user *database.User
+	var ok bool
+
+	method := "password"
+	if input.Code != "" || input.State != "" {
+		method = "oidc"
+		user, ok = app.oidcUser(w, r, input.Code, input.State)
+	} else {
+		user, ok = app.passwordUser(w, r, input.Email, input.Password)
+	}
+
+	if !ok {
+		return
+	}
+
+	accessToken, accessTokenExpiry, err := app.newAccessToken(user)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	refreshToken, storedRefreshToken, err := app.newRefreshToken(user, "")
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.db.InsertRefreshToken(r.Context(), storedRefreshToken)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.audit(r, database.AuditEvent{ActorID: &user.ID, Action: database.AuditLogin, TargetType: "user", TargetID: strconv.Itoa(user.ID), Details: database.AuditDetails{"method": method}})
+
+	data := tokenResponse(accessToken, accessTokenExpiry, refreshToken, storedRefreshToken.ExpiresAt)
+
+	err = app.writeJSON(w, http.StatusCreated, data, nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// passwordUser returns the user with the given email and password, or
+// responds with an error and returns false. Failed logins are slowed down per
+// email and client IP.
+func (app *application) passwordUser(w http.ResponseWriter, r *http.Request, email, plaintextPassword string) (*database.User, bool) {
+	if app.config.oidc.required {
+		app.errorMessage(w, r, http.StatusForbidden, "Password logins are disabled, log in with single sign-on instead", nil)
+		return nil, false
+	}
+
+	var v validator.Validator
+
+	v.CheckField(email != "", "Email", "Email is required")
+	v.CheckField(plaintextPassword != "", "Password", "Password is required")
+
+	if v.HasErrors() {
+		app.failedValidation(w, r, v)
+		return nil, false
+	}
+
+	// emails are case-insensitive, so are the keys their failures are counted by
+	accountKey := "login:email:" + strings.ToLower(email)
+	ipKey := "login:ip:" + clientIP(r)
+
+	if wait := app.loginWait(r.Context(), accountKey, ipKey); wait > 0 {
+		app.tooManyLoginAttempts(w, r, wait)
+		return nil, false
+	}
+
+	user, err := app.db.GetUserByEmail(r.Context(), email)
+	if err != nil {
+		app.serverError(w, r, err)
+		return nil, false
+	}
+
+	// unknown emails fail the same way, and take as long, as wrong passwords
+	passwordMatches := false
+
+	if user != nil {
+		passwordMatches, err = password.Matches(plaintextPassword, user.PasswordHash)
+		if err != nil {
+			app.serverError(w, r, err)
+			return nil, false
+		}
+	} else {
+		password.DummyMatches(plaintextPassword)
+	}
+
+	if !passwordMatches {
+		event := database.AuditEvent{Action: database.AuditLoginFailed, Details: database.AuditDetails{"email": email}}
+		if user != nil {
+			event.TargetType, event.TargetID = "user", strconv.Itoa(user.ID)
+		}
+		app.audit(r, event)
+
+		app.loginFailed(r.Context(), accountKey, ipKey)
+		app.invalidCredentials(w, r)
+		return nil, false
+	}
+
+	err = app.loginAccounts.Reset(r.Context(), accountKey)
+	if err != nil {
+		app.reportError(err)
+	}
+
+	return user, true
+}
+
+// oidcUser completes an OpenID Connect login and returns the user the
+// provider's identity belongs to. Unknown identities are linked to the user
+// with the same email if the provider verified it, and get a new user
+// otherwise.
+func (app *application) oidcUser(w http.ResponseWriter, r *http.Request, code, state string) (*database.User, bool) {
+	idToken, ok := app.exchangeOIDCCode(w, r, code, state, database.OIDCPurposeLogin, nil)
+	if !ok {
+		return nil, false
+	}
+
+	user, err := app.db.GetUserByIdentity(r.Context(), idToken.Issuer, idToken.Subject)
+	if err != nil {
+		app.serverError(w, r, err)
+		return nil, false
+	}
+
+	if user != nil {
+		return user, true
+	}
+
+	if idToken.Email == "" {
+		app.errorMessage(w, r, http.StatusUnprocessableEntity, "Your single sign-on provider didn't share your email address", nil)
+		return nil, false
+	}
+
+	user, err = app.db.GetUserByEmail(r.Context(), idToken.Email)
+	if err != nil {
+		app.serverError(w, r, err)
+		return nil, false
+	}
+
+	switch {
+	case user != nil && !idToken.EmailVerified:
+		// anybody could claim an unverified email, so this needs the
+		// account's password first
+		app.errorMessage(w, r, http.StatusConflict, "An account with your email already exists, log in with your password and link your single sign-on identity to it", nil)
+		return nil, false
+	case user == nil:
+		user, err = app.provisionUser(r.Context(), idToken)
+		if err != nil {
+			app.serverError(w, r, err)
+			return nil, false
+		}
+	}
+
+	err = app.db.InsertIdentity(r.Context(), &database.Identity{UserID: user.ID, Issuer: idToken.Issuer, Subject: idToken.Subject, Email: idToken.Email})
+	if err != nil {
+		app.serverError(w, r, err)
+		return nil, false
+	}
+
+	return user, true
+}
+
+func (app *application) refreshAuthenticationToken(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := request.DecodeJSON(w, r, &input)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	storedRefreshToken, err := app.db.GetRefreshTokenByHash(r.Context(), token.Hash(input.RefreshToken))
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if storedRefreshToken == nil || time.Now().After(storedRefreshToken.ExpiresAt) {
+		app.invalidRefreshToken(w, r)
+		return
+	}
+
+	// a refresh token being presented twice means it has leaked, so nothing
+	// issued from the same login can be trusted anymore
+	if storedRefreshToken.RevokedAt.Valid {
+		err = app.db.RevokeRefreshTokenFamily(r.Context(), storedRefreshToken.FamilyID)
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		app.audit(r, database.AuditEvent{ActorID: &storedRefreshToken.UserID, Action: database.AuditRefreshTokenReused, TargetType: "refresh_token_family", TargetID: storedRefreshToken.FamilyID})
+
+		app.invalidRefreshToken(w, r)
+		return
+	}
+
+	user, err := app.db.GetUser(r.Context(), storedRefreshToken.UserID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if user == nil {
+		app.invalidRefreshToken(w, r)
+		return
+	}
+
+	accessToken, accessTokenExpiry, err := app.newAccessToken(user)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	refreshToken, newRefreshToken, err := app.newRefreshToken(user, storedRefreshToken.FamilyID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.db.RotateRefreshToken(r.Context(), storedRefreshToken, newRefreshToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRefreshTokenReused):
+			app.invalidRefreshToken(w, r)
+		default:
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, database.AuditEvent{ActorID: &user.ID, Action: database.AuditTokenRefreshed, TargetType: "refresh_token_family", TargetID: storedRefreshToken.FamilyID})
+
+	data := tokenResponse(accessToken, accessTokenExpiry, refreshToken, newRefreshToken.ExpiresAt)
+
+	err = app.writeJSON(w, http.StatusCreated, data, nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) deleteAuthenticationToken(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	// the refresh token is optional, so an empty body is fine
+	if r.ContentLength != 0 {
+		err := request.DecodeJSON(w, r, &input)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+	}
+
+	claims := contextGetAccessToken(r)
+
+	if claims != nil && claims.ID != "" {
+		err := app.db.RevokeAccessToken(r.Context(), claims.ID, claims.Expires.Time())
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+	}
+
+	if input.RefreshToken != "" {
+		storedRefreshToken, err := app.db.GetRefreshTokenByHash(r.Context(), token.Hash(input.RefreshToken))
+		if err != nil {
+			app.serverError(w, r, err)
+			return
+		}
+
+		if storedRefreshToken != nil && storedRefreshToken.UserID == contextGetAuthenticatedUser(r).ID {
+			err = app.db.RevokeRefreshTokenFamily(r.Context(), storedRefreshToken.FamilyID)
+			if err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+		}
+	}
+
+	app.audit(r, database.AuditEvent{Action: database.AuditLogout})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name      string              `json:"name"`
+		Scopes    []string            `json:"scopes"`
+		ExpiresAt *time.Time          `json:"expires_at"`
+		Validator validator.Validator `json:"-"`
+	}
+
+	err := request.DecodeJSON(w, r, &input)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	input.Validator.CheckField(validator.NotBlank(input.Name), "Name", "Name is required")
+	input.Validator.CheckField(validator.MaxRunes(input.Name, 100), "Name", "Name must not be more than 100 characters")
+
+	input.Validator.CheckField(len(input.Scopes) > 0, "Scopes", "At least one scope is required")
+	input.Validator.CheckField(validator.AllIn(input.Scopes, contextGetPermissions(r)...), "Scopes", "Scopes must be any of "+strings.Join(contextGetPermissions(r), ", "))
+	input.Validator.CheckField(validator.NoDuplicates(input.Scopes), "Scopes", "Scopes must not contain duplicates")
+
+	if input.ExpiresAt != nil {
+		input.Validator.CheckField(input.ExpiresAt.After(time.Now()), "ExpiresAt", "Expiry must be in the future")
+	}
+
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	plaintext, hash, err := token.Generate(apiKeyPrefix)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	authenticatedUser := contextGetAuthenticatedUser(r)
+
+	key := &database.APIKey{
+		UserID:    authenticatedUser.ID,
+		Name:      input.Name,
+		Prefix:    plaintext[:len(apiKeyPrefix)+8],
+		Hash:      hash,
+		Scopes:    input.Scopes,
+		ExpiresAt: input.ExpiresAt,
+	}
+
+	err = app.db.InsertAPIKey(r.Context(), key)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.audit(r, database.AuditEvent{Action: database.AuditAPIKeyCreated, TargetType: "api_key", TargetID: strconv.Itoa(key.ID), Details: database.AuditDetails{"name": key.Name, "scopes": key.Scopes}})
+
+	// the plaintext key is only ever shown in this response
+	data := struct {
+		*database.APIKey
+		Key string `json:"key"`
+	}{key, plaintext}
+
+	err = app.writeJSON(w, http.StatusCreated, data, nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	authenticatedUser := contextGetAuthenticatedUser(r)
+
+	keys, err := app.db.ListAPIKeys(r.Context(), authenticatedUser.ID)
+
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, keys, nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) deleteAPIKey(w http.ResponseWriter, r *http.Request) {
+
+	keyID, err := strconv.Atoi(chi.URLParam(r, "keyID"))
+
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	authenticatedUser := contextGetAuthenticatedUser(r)
+
+	deleted, err := app.db.DeleteAPIKey(r.Context(), keyID, authenticatedUser.ID)
+
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !deleted {
+		app.notFound(w, r)
+		return
+	}
+
+	app.audit(r, database.AuditEvent{Action: database.AuditAPIKeyDeleted, TargetType: "api_key", TargetID: strconv.Itoa(keyID)})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) createOrganisation(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name      string              `json:"name"`
+		Validator validator.Validator `json:"-"`
+	}
+
+	err := request.DecodeJSON(w, r, &input)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	input.Validator.CheckField(input.Name != "", "Name", "Name is required")
+	input.Validator.CheckField(len(input.Name) <= 100, "Name", "Name must not be more than 100 characters")
+
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	authenticatedUser := contextGetAuthenticatedUser(r)
+
+	organisation := database.Organisation{Name: input.Name}
+
+	err = app.db.InsertOrganisation(r.Context(), &organisation, authenticatedUser.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.audit(r, database.AuditEvent{Action: database.AuditOrganisationCreated, TargetType: "organisation", TargetID: strconv.Itoa(organisation.ID)})
+
+	err = app.writeJSON(w, http.StatusCreated, organisation, nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) listOrganisations(w http.ResponseWriter, r *http.Request) {
+	authenticatedUser := contextGetAuthenticatedUser(r)
+
+	organisations, err := app.db.ListOrganisations(r.Context(), authenticatedUser.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, organisations, nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) getOrganisationUsage(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := strconv.Atoi(chi.URLParam(r, "organisationID"))
+
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	authenticatedUser := contextGetAuthenticatedUser(r)
+
+	organisation, err := app.memberOrganisation(r.Context(), organisationID, authenticatedUser.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if organisation == nil {
+		app.notFound(w, r)
+		return
+	}
+
+	usage, err := app.db.GetOrganisationUsage(r.Context(), organisation.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	data := map[string]any{
+		"plan":   organisation.Plan,
+		"usage":  usage,
+		"quotas": app.quotaFor(organisation.Plan),
+	}
+
+	err = app.writeJSON(w, http.StatusOK, data, nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) listMemberships(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := strconv.Atoi(chi.URLParam(r, "organisationID"))
+
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	authenticatedUser := contextGetAuthenticatedUser(r)
+
+	membership, err := app.db.GetMembership(r.Context(), organisationID, authenticatedUser.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if membership == nil {
+		app.notFound(w, r)
+		return
+	}
+
+	memberships, err := app.db.ListMemberships(r.Context(), organisationID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, memberships, nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// putMembership adds a user to an organisation by email, or changes the role
+// of an existing member. Only owners and admins may do so, and only owners
+// may hand out the owner role.
+func (app *application) putMembership(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := strconv.Atoi(chi.URLParam(r, "organisationID"))
+
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var input struct {
+		Email     string              `json:"email"`
+		Role      string              `json:"role"`
+		Validator validator.Validator `json:"-"`
+	}
+
+	err = request.DecodeJSON(w, r, &input)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	authenticatedUser := contextGetAuthenticatedUser(r)
+
+	membership, err := app.db.GetMembership(r.Context(), organisationID, authenticatedUser.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if membership == nil {
+		app.notFound(w, r)
+		return
+	}
+
+	if !membership.CanManage() || (input.Role == database.MembershipRoleOwner && membership.Role != database.MembershipRoleOwner) {
+		app.notPermitted(w, r)
+		return
+	}
+
+	user, err := app.db.GetUserByEmail(r.Context(), input.Email)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	input.Validator.CheckField(user != nil, "Email", "User could not be found")
+	input.Validator.CheckField(validator.In(input.Role, database.MembershipRoles...), "Role", "Role must be any of "+strings.Join(database.MembershipRoles, ", "))
+
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	if input.Role != database.MembershipRoleOwner && !app.canRemoveOwner(w, r, membership, user.ID) {
+		return
+	}
+
+	member := database.Membership{OrganisationID: organisationID, UserID: user.ID, Role: input.Role}
+
+	err = app.db.UpsertMembership(r.Context(), &member)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.audit(r, database.AuditEvent{Action: database.AuditMembershipChanged, TargetType: "organisation", TargetID: strconv.Itoa(organisationID), Details: database.AuditDetails{"user_id": user.ID, "role": member.Role}})
+
+	err = app.writeJSON(w, http.StatusOK, member, nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// deleteMembership removes a member from an organisation. Members may always
+// leave; removing anybody else takes an owner or admin.
+func (app *application) deleteMembership(w http.ResponseWriter, r *http.Request) {
+	organisationID, err := strconv.Atoi(chi.URLParam(r, "organisationID"))
+
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	authenticatedUser := contextGetAuthenticatedUser(r)
+
+	membership, err := app.db.GetMembership(r.Context(), organisationID, authenticatedUser.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if membership == nil {
+		app.notFound(w, r)
+		return
+	}
+
+	if userID != authenticatedUser.ID && !membership.CanManage() {
+		app.notPermitted(w, r)
+		return
+	}
+
+	if !app.canRemoveOwner(w, r, membership, userID) {
+		return
+	}
+
+	deleted, err := app.db.DeleteMembership(r.Context(), organisationID, userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !deleted {
+		app.notFound(w, r)
+		return
+	}
+
+	app.audit(r, database.AuditEvent{Action: database.AuditMembershipRemoved, TargetType: "organisation", TargetID: strconv.Itoa(organisationID), Details: database.AuditDetails{"user_id": userID}})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// canRemoveOwner is called before the membership of userID is removed or
+// demoted. If they are an owner it rejects the request unless actor is an
+// owner too and the organisation keeps at least one other owner.
+func (app *application) canRemoveOwner(w http.ResponseWriter, r *http.Request, actor *database.Membership, userID int) bool {
+	organisationID := actor.OrganisationID
+
+	membership, err := app.db.GetMembership(r.Context(), organisationID, userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return false
+	}
+
+	if membership == nil || membership.Role != database.MembershipRoleOwner {
+		return true
+	}
+
+	if actor.Role != database.MembershipRoleOwner {
+		app.notPermitted(w, r)
+		return false
+	}
+
+	owners, err := app.db.CountOwners(r.Context(), organisationID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return false
+	}
+
+	if owners <= 1 {
+		app.errorMessage(w, r, http.StatusConflict, "An organisation must keep at least one owner", nil)
+		return false
+	}
+
+	return true
+}
+
+func (app *application) adminListTasks(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	filters := database.Filters{
+		Page:     app.readInt(qs, "page", 1),
+		PageSize: app.readInt(qs, "page_size", 10),
+	}
+
+	tasks, err := app.db.ListAllTasks(r.Context(), app.readInt(qs, "user_id", 0), filters)
+
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, adminTasks(tasks), nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) adminGetTask(w http.ResponseWriter, r *http.Request) {
+
+	taskIdInt, err := strconv.Atoi(chi.URLParam(r, "taskID"))
+
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	task, err := app.db.GetTaskByID(r.Context(), taskIdInt)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			app.notFound(w, r)
+		default:
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, adminTasks([]*database.Task{task})[0], nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) adminDeleteTask(w http.ResponseWriter, r *http.Request) {
+
+	taskIdInt, err := strconv.Atoi(chi.URLParam(r, "taskID"))
+
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	deleted, err := app.db.DeleteTaskByID(r.Context(), taskIdInt)
+
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if !deleted {
+		app.notFound(w, r)
+		return
+	}
+
+	app.audit(r, database.AuditEvent{Action: database.AuditAdminTaskDeleted, TargetType: "task", TargetID: strconv.Itoa(taskIdInt)})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (app *application) adminListUsers(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	filters := database.Filters{
+		Page:     app.readInt(qs, "page", 1),
+		PageSize: app.readInt(qs, "page_size", 10),
+	}
+
+	users, err := app.db.ListUsers(r.Context(), filters)
+
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, adminUsers(users), nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) adminUpdateUser(w http.ResponseWriter, r *http.Request) {
+
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var input struct {
+		Role      *string             `json:"role"`
+		Plan      *string             `json:"plan"`
+		Validator validator.Validator `json:"-"`
+	}
+
+	err = request.DecodeJSON(w, r, &input)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	user, err := app.db.GetUser(r.Context(), userID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	if user == nil {
+		app.notFound(w, r)
+		return
+	}
+
+	details := database.AuditDetails{}
+
+	if input.Role != nil {
+		details["role"] = map[string]string{"from": user.Role, "to": *input.Role}
+		input.Validator.CheckField(validator.In(*input.Role, database.Roles...), "Role", "Role must be any of "+strings.Join(database.Roles, ", "))
+		user.Role = *input.Role
+	}
+
+	if input.Plan != nil {
+		details["plan"] = map[string]string{"from": user.Plan, "to": *input.Plan}
+		_, ok := app.config.quotas[*input.Plan]
+		input.Validator.CheckField(ok, "Plan", "Plan does not exist")
+		user.Plan = *input.Plan
+	}
+
+	if input.Validator.HasErrors() {
+		app.failedValidation(w, r, input.Validator)
+		return
+	}
+
+	err = app.db.UpdateUserRoleAndPlan(r.Context(), user)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	app.audit(r, database.AuditEvent{Action: database.AuditAdminUserUpdated, TargetType: "user", TargetID: strconv.Itoa(user.ID), Details: details})
+
+	err = app.writeJSON(w, http.StatusOK, adminUsers([]*database.User{user})[0], nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// adminListAudit lists audit events, newest first. With format=jsonl, or an
+// Accept header asking for application/x-ndjson, every matching event is
+// exported instead as JSON Lines, oldest first.
+func (app *application) adminListAudit(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	var v validator.Validator
+
+	auditFilters := database.AuditFilters{
+		ActorID:    app.readInt(qs, "actor_id", 0),
+		Action:     qs.Get("action"),
+		TargetType: qs.Get("target_type"),
+		TargetID:   qs.Get("target_id"),
+	}
+
+	for key, dst := range map[string]*time.Time{"Since": &auditFilters.Since, "Until": &auditFilters.Until} {
+		if value := qs.Get(strings.ToLower(key)); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			v.CheckField(err == nil, key, "Must be an RFC 3339 timestamp")
+			*dst = t
+		}
+	}
+
+	if v.HasErrors() {
+		app.failedValidation(w, r, v)
+		return
+	}
+
+	if qs.Get("format") == "jsonl" || strings.Contains(r.Header.Get("Accept"), "application/x-ndjson") {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+		w.WriteHeader(http.StatusOK)
+
+		enc := json.NewEncoder(w)
+
+		// the status is already sent, so failures can only be reported
+		err := app.db.ExportAuditEvents(r.Context(), auditFilters, func(event *database.AuditEvent) error {
+			return enc.Encode(event)
+		})
+		if err != nil {
+			app.reportError(err)
+		}
+		return
+	}
+
+	filters := database.Filters{
+		Page:     app.readInt(qs, "page", 1),
+		PageSize: app.readInt(qs, "page_size", 50),
+	}
+
+	events, err := app.db.ListAuditEvents(r.Context(), auditFilters, filters)
+
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, events, nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// adminGetReconciler reports what the last reconciliation of stuck tasks
+// found and did.
+func (app *application) adminGetReconciler(w http.ResponseWriter, r *http.Request) {
+	if app.reconciler == nil {
+		app.errorMessage(w, r, http.StatusNotFound, "The reconciler is disabled", nil)
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, map[string]any{
+		"interval":   app.config.reconciler.Interval.String(),
+		"grace":      app.config.reconciler.Grace.String(),
+		"last_run":   app.reconciler.LastRun(),
+		"batch_size": app.config.reconciler.BatchSize,
+	}, nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// adminGetMetrics serves the reconciler's running totals. Only those are
+// published, the rest of expvar includes the command line with its secrets.
+func (app *application) adminGetMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics := map[string]any{}
+
+	if v := expvar.Get("reconciler"); v != nil {
+		metrics["reconciler"] = json.RawMessage(v.String())
+	}
+
+	err := app.writeJSON(w, http.StatusOK, metrics, nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+type adminTask struct {
+	*database.Task
+	UserID int `json:"user_id"`
+}
+
+// adminTasks exposes the owner of every task, which users never see for
+// their own tasks.
+func adminTasks(tasks []*database.Task) []adminTask {
+	views := make([]adminTask, len(tasks))
+
+	for i, task := range tasks {
+		views[i] = adminTask{Task: task, UserID: task.UserId}
+	}
+
+	return views
+}
+
+type adminUser struct {
+	ID        int       `json:"id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	Plan      string    `json:"plan"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func adminUsers(users []*database.User) []adminUser {
+	views := make([]adminUser, len(users))
+
+	for i, user := range users {
+		views[i] = adminUser{
+			ID:        user.ID,
+			Email:     user.Email,
+			Role:      user.Role,
+			Plan:      user.Plan,
+			CreatedAt: user.CreatedAt,
+			UpdatedAt: user.UpdatedAt,
+		}
+	}
+
+	return views
+}
+
+// startOIDCLogin redirects to the OpenID Connect provider's login page. The
+// provider then redirects to the configured redirect URL with a code and
+// state, which are exchanged for tokens with POST /authentication-tokens.
+func (app *application) startOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	app.startOIDC(w, r, database.OIDCPurposeLogin, nil)
+}
+
+// startIdentityLink is startOIDCLogin for linking an identity to the
+// authenticated user, the code and state are redeemed with
+// POST /me/identities by the same user.
+func (app *application) startIdentityLink(w http.ResponseWriter, r *http.Request) {
+	userID := contextGetAuthenticatedUser(r).ID
+
+	app.startOIDC(w, r, database.OIDCPurposeLink, &userID)
+}
+
+func (app *application) startOIDC(w http.ResponseWriter, r *http.Request, purpose string, userID *int) {
+	if app.oidc == nil {
+		app.notFound(w, r)
+		return
+	}
+
+	state, stateHash, err := token.Generate("")
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	nonce, err := token.RandomID()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	verifier, err := oidc.NewVerifier()
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.db.InsertOIDCLogin(r.Context(), &database.OIDCLogin{
+		StateHash:    stateHash,
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+		Purpose:      purpose,
+		UserID:       userID,
+		ExpiresAt:    time.Now().Add(oidcLoginTTL),
+	})
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	authorizationURL, err := app.oidc.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", authorizationURL)
+
+	err = app.writeJSON(w, http.StatusFound, map[string]string{"authorization_url": authorizationURL, "state": state}, headers)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) listIdentities(w http.ResponseWriter, r *http.Request) {
+	authenticatedUser := contextGetAuthenticatedUser(r)
+
+	identities, err := app.db.ListIdentities(r.Context(), authenticatedUser.ID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, identities, nil)
+
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+// createIdentity links the identity of a completed OpenID Connect login to
+// the authenticated user, so they can log in with it from then on.
+func (app *application) createIdentity(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code  string `json:"code"`
+		State string `json:"state"`
+	}
+
+	err := request.DecodeJSON(w, r, &input)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	userID := contextGetAuthenticatedUser(r).ID
+
+	idToken, ok := app.exchangeOIDCCode(w, r, input.Code, input.State, database.OIDCPurposeLink, &userID)
+	if !ok {
+		return
+	}
+
+	identity := database.Identity{
+		UserID:  userID,
+		Issuer:  idToken.Issuer,
+		Subject: idToken.Subject,
+		Email:   idToken.Email,
+	}
+
+	err = app.db.InsertIdentity(r.Context(), &identity)
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrIdentityLinked):
+			app.errorMessage(w, r, http.StatusConflict, "This identity is already linked to an account", nil)
+		default:
+			app.serverError(w, r, err)
+		}
+		return
+	}
+
+	app.audit(r, database.AuditEvent{Action: database.AuditIdentityLinked, TargetType: "user", TargetID: strconv.Itoa(identity.UserID), Details: database.AuditDetails{"issuer": identity.Issuer}})
+
+	err = app.writeJSON(w, http.StatusCreated, identity, nil)
 
 	if err != nil {
 		app.serverError(w, r, err)
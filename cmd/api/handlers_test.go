@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Babatunde50/distributask/internal/database"
+	"github.com/Babatunde50/distributask/internal/database/memory"
+	"github.com/Babatunde50/distributask/internal/keyset"
+	"github.com/Babatunde50/distributask/internal/worker"
+)
+
+const createTaskBody = `{
+	"type": "image_processing",
+	"payload": {"url": "https://example.com/cat.png", "operation": "resize"},
+	"params": {"width": 100, "height": 100}
+}`
+
+// newTestApplication returns an application backed by memory.Store, with rate
+// limiting off and a free plan of at most dailyTasks tasks a day.
+func newTestApplication(t *testing.T, dailyTasks int) (*application, *memory.Store) {
+	t.Helper()
+
+	keys := keyset.New()
+
+	err := keys.AddSecret([]byte("test-secret"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg config
+	cfg.baseURL = "http://api.test"
+	cfg.jwt.accessTokenTTL = time.Minute
+	cfg.quotas = map[string]quota{defaultPlan: {MaxActiveTasks: 10, MaxDailyTasks: dailyTasks}}
+
+	store := memory.New()
+
+	app := &application{
+		config:          cfg,
+		db:              store,
+		keys:            keys,
+		taskDistributor: worker.NewMemoryTaskDistributor(),
+	}
+
+	return app, store
+}
+
+// newTestUser creates a user with email, activated or not, and returns an access token
+// of theirs.
+func newTestUser(t *testing.T, app *application, store *memory.Store, email string, activated bool) (*database.User, string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	id, err := store.InsertUser(ctx, email, "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if activated {
+		err = store.ActivateUser(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	user, err := store.GetUser(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, _, err := app.newAccessToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user, token
+}
+
+func send(app *application, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+
+	w := httptest.NewRecorder()
+	app.routes().ServeHTTP(w, r)
+
+	return w
+}
+
+func TestCreateTask(t *testing.T) {
+	app, store := newTestApplication(t, 10)
+	user, token := newTestUser(t, app, store, "alice@example.com", true)
+
+	w := send(app, http.MethodPost, "/tasks", token, createTaskBody)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST /tasks responded %d: %s", w.Code, w.Body)
+	}
+
+	ctx := context.Background()
+
+	tasks, err := store.ListTasks(ctx, user.ID, 0, database.Filters{Page: 1, PageSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tasks) != 1 {
+		t.Fatalf("user has %d tasks, want 1", len(tasks))
+	}
+
+	if tasks[0].Status != database.TaskStatusQueued || tasks[0].Payload.Params.ResizeParams.Width != 100 {
+		t.Errorf("created task %+v", tasks[0])
+	}
+
+	messages := store.OutboxMessages()
+	if len(messages) != 1 || messages[0].Type != worker.TaskSendTask {
+		t.Errorf("outbox holds %d messages, want one %s", len(messages), worker.TaskSendTask)
+	}
+
+	events, err := store.ListAuditEvents(ctx, database.AuditFilters{Action: database.AuditTaskCreated}, database.Filters{Page: 1, PageSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0].ActorID == nil || *events[0].ActorID != user.ID || events[0].TargetID != strconv.Itoa(tasks[0].ID) {
+		t.Errorf("task creation wasn't audited: %+v", events)
+	}
+}
+
+func TestCreateTaskRequiresActivation(t *testing.T) {
+	app, store := newTestApplication(t, 10)
+	_, token := newTestUser(t, app, store, "alice@example.com", false)
+
+	w := send(app, http.MethodPost, "/tasks", token, createTaskBody)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("POST /tasks responded %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	if messages := store.OutboxMessages(); len(messages) != 0 {
+		t.Errorf("outbox holds %d messages, want none", len(messages))
+	}
+}
+
+func TestCreateTaskDailyQuotaSurvivesDeletes(t *testing.T) {
+	app, store := newTestApplication(t, 2)
+	_, token := newTestUser(t, app, store, "alice@example.com", true)
+
+	for i := 1; i <= 2; i++ {
+		w := send(app, http.MethodPost, "/tasks", token, createTaskBody)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("POST /tasks responded %d: %s", w.Code, w.Body)
+		}
+
+		w = send(app, http.MethodDelete, "/tasks/"+strconv.Itoa(i), token, "")
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("DELETE /tasks/%d responded %d: %s", i, w.Code, w.Body)
+		}
+	}
+
+	w := send(app, http.MethodPost, "/tasks", token, createTaskBody)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("POST /tasks over the daily quota responded %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestDeleteTaskOfAnotherUser(t *testing.T) {
+	app, store := newTestApplication(t, 10)
+	_, aliceToken := newTestUser(t, app, store, "alice@example.com", true)
+	_, bobToken := newTestUser(t, app, store, "bob@example.com", true)
+
+	w := send(app, http.MethodPost, "/tasks", aliceToken, createTaskBody)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST /tasks responded %d: %s", w.Code, w.Body)
+	}
+
+	for _, path := range []string{"/tasks/1", "/tasks/2"} {
+		w = send(app, http.MethodDelete, path, bobToken, "")
+		if w.Code != http.StatusNotFound {
+			t.Errorf("DELETE %s of another user's or no task responded %d, want %d", path, w.Code, http.StatusNotFound)
+		}
+	}
+
+	if _, err := store.GetTaskByID(context.Background(), 1); err != nil {
+		t.Errorf("task is gone: %v", err)
+	}
+
+	events, err := store.ListAuditEvents(context.Background(), database.AuditFilters{Action: database.AuditTaskDeleted}, database.Filters{Page: 1, PageSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 0 {
+		t.Errorf("%d task deletions audited, want none", len(events))
+	}
+}
+
+func TestCreateTaskPriority(t *testing.T) {
+	app, store := newTestApplication(t, 10)
+	_, token := newTestUser(t, app, store, "alice@example.com", true)
+
+	high := strings.Replace(createTaskBody, `"type"`, `"priority": 3, "type"`, 1)
+
+	w := send(app, http.MethodPost, "/tasks", token, high)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST /tasks responded %d: %s", w.Code, w.Body)
+	}
+
+	messages := store.OutboxMessages()
+	if len(messages) != 1 || messages[0].Queue != worker.QueueCritical {
+		t.Errorf("high priority task wasn't queued on %s: %+v", worker.QueueCritical, messages)
+	}
+
+	invalid := strings.Replace(createTaskBody, `"type"`, `"priority": 4, "type"`, 1)
+
+	w = send(app, http.MethodPost, "/tasks", token, invalid)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("POST /tasks with priority 4 responded %d, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestGetTaskOfAnotherUser(t *testing.T) {
+	app, store := newTestApplication(t, 10)
+	_, aliceToken := newTestUser(t, app, store, "alice@example.com", true)
+	_, bobToken := newTestUser(t, app, store, "bob@example.com", true)
+
+	w := send(app, http.MethodPost, "/tasks", aliceToken, createTaskBody)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST /tasks responded %d: %s", w.Code, w.Body)
+	}
+
+	for _, path := range []string{"/tasks/1", "/tasks/1/results", "/tasks/1/results/original", "/tasks/2"} {
+		w = send(app, http.MethodGet, path, bobToken, "")
+		if w.Code != http.StatusNotFound {
+			t.Errorf("GET %s of another user's or no task responded %d, want %d", path, w.Code, http.StatusNotFound)
+		}
+	}
+}
@@ -1,13 +1,32 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Babatunde50/distributask/internal/database"
+	"github.com/Babatunde50/distributask/internal/oidc"
+	"github.com/Babatunde50/distributask/internal/password"
+	"github.com/Babatunde50/distributask/internal/token"
+	"github.com/Babatunde50/distributask/internal/validator"
+	"github.com/Babatunde50/distributask/internal/worker"
+	"github.com/hibiken/asynq"
+	"github.com/pascaldekloe/jwt"
 )
 
+var allowedUploadContentTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
 func (app *application) backgroundTask(fn func() error) {
 	app.wg.Add(1)
 
@@ -28,6 +47,151 @@ func (app *application) backgroundTask(fn func() error) {
 	}()
 }
 
+// audit records event with the actor, client and request it came from. The
+// actor defaults to the authenticated user. Failing to record an event is
+// reported but doesn't fail the request.
+func (app *application) audit(r *http.Request, event database.AuditEvent) {
+	if event.ActorID == nil {
+		if user := contextGetAuthenticatedUser(r); user != nil {
+			event.ActorID = &user.ID
+		}
+	}
+
+	if key := contextGetAPIKey(r); key != nil {
+		event.APIKeyID = &key.ID
+	}
+
+	event.IP = clientIP(r)
+	event.UserAgent = r.UserAgent()
+	event.RequestID = contextGetRequestID(r)
+
+	err := app.db.InsertAuditEvent(r.Context(), &event)
+	if err != nil {
+		app.reportError(err)
+	}
+}
+
+// exchangeOIDCCode redeems the code of the OpenID Connect login started with
+// state, or responds with an error and returns false. The login must have
+// been started for purpose, and for linking by the user with userID, so a
+// code and state can't be redeemed by anybody else than who asked for them.
+func (app *application) exchangeOIDCCode(w http.ResponseWriter, r *http.Request, code, state, purpose string, userID *int) (*oidc.IDToken, bool) {
+	if app.oidc == nil {
+		app.errorMessage(w, r, http.StatusBadRequest, "Single sign-on is not enabled", nil)
+		return nil, false
+	}
+
+	var v validator.Validator
+
+	v.CheckField(code != "", "Code", "Code is required")
+	v.CheckField(state != "", "State", "State is required")
+
+	if v.HasErrors() {
+		app.failedValidation(w, r, v)
+		return nil, false
+	}
+
+	login, err := app.db.ConsumeOIDCLogin(r.Context(), token.Hash(state))
+	if err != nil {
+		app.serverError(w, r, err)
+		return nil, false
+	}
+
+	if login == nil || login.Purpose != purpose || !sameUserID(login.UserID, userID) {
+		app.errorMessage(w, r, http.StatusUnauthorized, "Invalid or expired single sign-on login, please start again", nil)
+		return nil, false
+	}
+
+	idToken, err := app.oidc.Exchange(r.Context(), code, login.CodeVerifier, login.Nonce)
+	if err != nil {
+		// the code comes from the client, so a rejected one is their error
+		app.reportError(err)
+		app.errorMessage(w, r, http.StatusUnauthorized, "Single sign-on login failed, please start again", nil)
+		return nil, false
+	}
+
+	return idToken, true
+}
+
+// sameUserID reports whether a and b are both nil or the same ID.
+func sameUserID(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
+
+// provisionUser creates the user for a new single sign-on identity. They get
+// a random password, which they can replace with a password reset.
+func (app *application) provisionUser(ctx context.Context, idToken *oidc.IDToken) (*database.User, error) {
+	randomPassword, _, err := token.Generate("")
+	if err != nil {
+		return nil, err
+	}
+
+	hashedPassword, err := password.Hash(randomPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := app.db.InsertUser(ctx, idToken.Email, hashedPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	if idToken.EmailVerified {
+		err = app.db.ActivateUser(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return app.db.GetUser(ctx, id)
+}
+
+// loginWait returns how long a login for accountKey from ipKey has to wait
+// after earlier failed attempts. Like rate limiting it fails open when Redis
+// is unavailable.
+func (app *application) loginWait(ctx context.Context, accountKey, ipKey string) time.Duration {
+	accountWait, err := app.loginAccounts.Wait(ctx, accountKey)
+	if err != nil {
+		app.reportError(err)
+	}
+
+	ipWait, err := app.loginIPs.Wait(ctx, ipKey)
+	if err != nil {
+		app.reportError(err)
+	}
+
+	if ipWait > accountWait {
+		return ipWait
+	}
+
+	return accountWait
+}
+
+func (app *application) loginFailed(ctx context.Context, accountKey, ipKey string) {
+	_, err := app.loginAccounts.Fail(ctx, accountKey)
+	if err != nil {
+		app.reportError(err)
+	}
+
+	_, err = app.loginIPs.Fail(ctx, ipKey)
+	if err != nil {
+		app.reportError(err)
+	}
+}
+
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return ip
+}
+
 func (app *application) writeJSON(w http.ResponseWriter, status int, data interface{}, headers http.Header) error {
 	js, err := json.MarshalIndent(data, "", "\t")
 	if err != nil {
@@ -68,3 +232,283 @@ func (app *application) readString(qs url.Values, key string, defaultValue strin
 	}
 	return s
 }
+
+func isMultipartRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// readImageUpload parses a multipart/form-data request and returns the image
+// sent in its "image" field along with its sniffed content type. Any other
+// form fields are available through r.FormValue afterwards.
+func (app *application) readImageUpload(w http.ResponseWriter, r *http.Request) ([]byte, string, error) {
+	maxBytes := app.config.storage.uploadMaxBytes
+
+	// allow some headroom for the multipart framing and other form fields
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+1_048_576)
+
+	err := r.ParseMultipartForm(maxBytes)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			return nil, "", fmt.Errorf("image must not be larger than %d bytes", maxBytes)
+		}
+		return nil, "", fmt.Errorf("body contains a badly-formed multipart form: %v", err)
+	}
+
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		if errors.Is(err, http.ErrMissingFile) {
+			return nil, "", errors.New("an image file must be provided in the image field")
+		}
+		return nil, "", err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if int64(len(data)) > maxBytes {
+		return nil, "", fmt.Errorf("image must not be larger than %d bytes", maxBytes)
+	}
+
+	contentType := http.DetectContentType(data)
+	if !validator.In(contentType, allowedUploadContentTypes...) {
+		return nil, "", errors.New("image must be a JPEG, PNG, GIF or WebP file")
+	}
+
+	return data, contentType, nil
+}
+
+// saveUpload writes an uploaded image to the storage backend and records it
+// against the user.
+func (app *application) saveUpload(ctx context.Context, userID int, data []byte, contentType string) (*database.Upload, error) {
+	id, err := database.NewUploadID()
+	if err != nil {
+		return nil, err
+	}
+
+	upload := &database.Upload{
+		ID:          id,
+		UserID:      userID,
+		ContentType: contentType,
+		Size:        len(data),
+	}
+
+	err = app.storage.Put(ctx, upload.StorageKey(), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.db.InsertUpload(ctx, upload)
+	if err != nil {
+		app.storage.Delete(ctx, upload.StorageKey())
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+func (app *application) quotaFor(plan string) quota {
+	q, ok := app.config.quotas[plan]
+	if !ok {
+		return app.config.quotas[defaultPlan]
+	}
+
+	return q
+}
+
+// memberOrganisation returns the organisation if the user is a member of it,
+// and nil otherwise so non-members can't tell it exists.
+func (app *application) memberOrganisation(ctx context.Context, organisationID, userID int) (*database.Organisation, error) {
+	membership, err := app.db.GetMembership(ctx, organisationID, userID)
+	if err != nil || membership == nil {
+		return nil, err
+	}
+
+	return app.db.GetOrganisation(ctx, organisationID)
+}
+
+// checkQuota returns the status code and message to reject a new task with,
+// or zero if the user may create it. Tasks of an organisation are counted
+// against the organisation's quotas rather than the user's.
+func (app *application) checkQuota(ctx context.Context, user *database.User, organisation *database.Organisation) (int, string, error) {
+	var q quota
+	var usage *database.Usage
+	var err error
+
+	if organisation != nil {
+		q = app.quotaFor(organisation.Plan)
+		usage, err = app.db.GetOrganisationUsage(ctx, organisation.ID)
+	} else {
+		q = app.quotaFor(user.Plan)
+		usage, err = app.db.GetUsage(ctx, user.ID)
+	}
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	switch {
+	case q.MaxActiveTasks > 0 && usage.ActiveTasks >= q.MaxActiveTasks:
+		return http.StatusTooManyRequests, quotaMessage(&database.QuotaError{Quota: database.QuotaActiveTasks, Limit: q.MaxActiveTasks}), nil
+	case q.MaxDailyTasks > 0 && usage.TasksToday >= q.MaxDailyTasks:
+		return http.StatusTooManyRequests, quotaMessage(&database.QuotaError{Quota: database.QuotaDailyTasks, Limit: q.MaxDailyTasks}), nil
+	case q.MaxStorageBytes > 0 && usage.StorageBytes >= q.MaxStorageBytes:
+		return http.StatusForbidden, "You have used all of your result storage, delete some tasks before creating more", nil
+	}
+
+	return 0, "", nil
+}
+
+// quotaMessage tells the client which task quota it has reached.
+func quotaMessage(err *database.QuotaError) string {
+	if err.Quota == database.QuotaActiveTasks {
+		return fmt.Sprintf("You already have %d queued or in-progress tasks, wait for some to finish before creating more", err.Limit)
+	}
+
+	return fmt.Sprintf("You have reached your quota of %d tasks per day", err.Limit)
+}
+
+// sendUserToken stores a new single-use token of the given scope and queues
+// an email handing it to the user. The template gets the plaintext token as
+// tokenName, alongside the API's baseURL and when the token expires.
+func (app *application) sendUserToken(ctx context.Context, user *database.User, scope string, ttl time.Duration, templateFile, tokenName string) error {
+	plaintext, hash, err := token.Generate("")
+	if err != nil {
+		return err
+	}
+
+	err = app.db.InsertUserToken(ctx, hash, user.ID, scope, time.Now().Add(ttl))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 4*time.Second)
+	defer cancel()
+
+	return app.taskDistributor.DistributeTaskSendEmail(ctx, &worker.PayloadSendEmail{
+		Recipient:    user.Email,
+		TemplateFile: templateFile,
+		Data: map[string]any{
+			"baseURL": app.config.baseURL,
+			"expiry":  humanDuration(ttl),
+			tokenName: plaintext,
+		},
+	}, asynq.MaxRetry(5), asynq.Queue(worker.QueueCritical))
+}
+
+// humanDuration formats d for people, e.g. "3 days" or "45 minutes".
+func humanDuration(d time.Duration) string {
+	unit, size := "minute", time.Minute
+
+	switch {
+	case d%(24*time.Hour) == 0:
+		unit, size = "day", 24*time.Hour
+	case d%time.Hour == 0:
+		unit, size = "hour", time.Hour
+	}
+
+	n := int(d / size)
+	if n == 1 {
+		return "1 " + unit
+	}
+
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// seconds returns d in seconds, or nil if d is nil.
+func seconds(d *time.Duration) *float64 {
+	if d == nil {
+		return nil
+	}
+
+	s := d.Seconds()
+	return &s
+}
+
+// grantedPermissions narrows the permissions a token or API key claims down to
+// those the user's current role still allows, so demoting a user takes
+// effect immediately.
+func grantedPermissions(user *database.User, claimed []string) []string {
+	allowed := database.PermissionsForRole(user.Role)
+
+	var granted []string
+	for _, permission := range claimed {
+		if validator.In(permission, allowed...) {
+			granted = append(granted, permission)
+		}
+	}
+
+	return granted
+}
+
+// newAccessToken signs a short-lived JWT for user. Its jti allows it to be
+// revoked before it expires.
+func (app *application) newAccessToken(user *database.User) (string, time.Time, error) {
+	jti, err := token.RandomID()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	var claims jwt.Claims
+	claims.Subject = strconv.Itoa(user.ID)
+	claims.ID = jti
+	claims.Set = map[string]any{
+		"role":  user.Role,
+		"scope": strings.Join(database.PermissionsForRole(user.Role), " "),
+	}
+
+	now := time.Now()
+	expiry := now.Add(app.config.jwt.accessTokenTTL)
+	claims.Issued = jwt.NewNumericTime(now)
+	claims.NotBefore = jwt.NewNumericTime(now)
+	claims.Expires = jwt.NewNumericTime(expiry)
+
+	claims.Issuer = app.config.baseURL
+	claims.Audiences = []string{app.config.baseURL}
+
+	jwtBytes, err := app.keys.Sign(&claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return string(jwtBytes), expiry, nil
+}
+
+// newRefreshToken creates an unsaved refresh token for user in the given
+// token family, or in a new family if familyID is empty.
+func (app *application) newRefreshToken(user *database.User, familyID string) (string, *database.RefreshToken, error) {
+	if familyID == "" {
+		id, err := token.RandomID()
+		if err != nil {
+			return "", nil, err
+		}
+		familyID = id
+	}
+
+	plaintext, hash, err := token.Generate("")
+	if err != nil {
+		return "", nil, err
+	}
+
+	refreshToken := &database.RefreshToken{
+		UserID:    user.ID,
+		FamilyID:  familyID,
+		Hash:      hash,
+		ExpiresAt: time.Now().Add(app.config.jwt.refreshTokenTTL),
+	}
+
+	return plaintext, refreshToken, nil
+}
+
+func tokenResponse(accessToken string, accessTokenExpiry time.Time, refreshToken string, refreshTokenExpiry time.Time) map[string]string {
+	return map[string]string{
+		"AuthenticationToken":       accessToken,
+		"AuthenticationTokenExpiry": accessTokenExpiry.Format(time.RFC3339),
+		"RefreshToken":              refreshToken,
+		"RefreshTokenExpiry":        refreshTokenExpiry.Format(time.RFC3339),
+	}
+}
@@ -1,14 +1,26 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"os"
+	"runtime"
 	"runtime/debug"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/Babatunde50/distributask/internal/database"
+	"github.com/Babatunde50/distributask/internal/fetcher"
+	"github.com/Babatunde50/distributask/internal/keyset"
+	"github.com/Babatunde50/distributask/internal/mailer"
+	"github.com/Babatunde50/distributask/internal/oidc"
+	"github.com/Babatunde50/distributask/internal/ratelimit"
+	"github.com/Babatunde50/distributask/internal/storage"
 	"github.com/Babatunde50/distributask/internal/version"
 	"github.com/Babatunde50/distributask/internal/worker"
+	"github.com/go-redis/redis/v8"
 	"github.com/hibiken/asynq"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -32,15 +44,95 @@ type config struct {
 		automigrate bool
 	}
 	jwt struct {
-		secretKey string
+		secretKey       string
+		devSecret       bool
+		signingKeyFile  string
+		verifyKeyFiles  []string
+		accessTokenTTL  time.Duration
+		refreshTokenTTL time.Duration
 	}
+	storage struct {
+		dir            string
+		uploadMaxBytes int64
+	}
+	fetcher struct {
+		maxBytes     int64
+		maxRedirects int
+		allowPrivate bool
+	}
+	redis struct {
+		addr string
+	}
+	queue struct {
+		backend  string
+		postgres worker.PostgresQueueConfig
+	}
+	oidc struct {
+		issuer       string
+		clientID     string
+		clientSecret string
+		redirectURL  string
+		scopes       string
+		required     bool
+	}
+	smtp struct {
+		host     string
+		port     int
+		username string
+		password string
+		sender   string
+	}
+	limiter struct {
+		enabled bool
+		ip      ratelimit.Limit
+		plans   map[string]ratelimit.Limit
+	}
+	login struct {
+		account ratelimit.BackoffPolicy
+		ip      ratelimit.BackoffPolicy
+	}
+	quotas map[string]quota
+	worker struct {
+		maxTasksPerUser int
+	}
+	outbox     worker.OutboxRelayConfig
+	reconciler worker.ReconcilerConfig
+}
+
+// quota limits what a single account may consume. Zero means unlimited.
+type quota struct {
+	MaxActiveTasks  int   `json:"max_active_tasks"`
+	MaxDailyTasks   int   `json:"max_daily_tasks"`
+	MaxStorageBytes int64 `json:"max_storage_bytes"`
 }
 
+const (
+	defaultPlan = "free"
+
+	// devJWTSecret signs JWTs when no key is configured and -jwt-dev-secret
+	// is set, so the API runs out of the box in development.
+	devJWTSecret = "xb37u2w4i57oooowambofjbhfbkemrj7"
+
+	// apiKeyPrefix starts every API key, telling them apart from JWTs.
+	apiKeyPrefix = "dtk_"
+
+	activationTokenTTL    = 3 * 24 * time.Hour
+	passwordResetTokenTTL = 45 * time.Minute
+	oidcLoginTTL          = 10 * time.Minute
+)
+
 type application struct {
 	config          config
-	db              *database.DB
+	db              database.Store
+	storage         storage.Storage
+	keys            *keyset.Keyset
+	oidc            *oidc.Provider
+	limiter         *ratelimit.Limiter
+	loginAccounts   *ratelimit.Backoff
+	loginIPs        *ratelimit.Backoff
 	wg              sync.WaitGroup
 	taskDistributor worker.TaskDistributor
+	reconciler      *worker.Reconciler
 }
 
 func run() error {
@@ -50,7 +142,95 @@ func run() error {
 	flag.IntVar(&cfg.httpPort, "http-port", 4444, "port to listen on for HTTP requests")
 	flag.StringVar(&cfg.db.dsn, "db-dsn", "distributask:pa55word@postgres/distributask?sslmode=disable", "postgreSQL DSN")
 	flag.BoolVar(&cfg.db.automigrate, "db-automigrate", true, "run migrations on startup")
-	flag.StringVar(&cfg.jwt.secretKey, "jwt-secret-key", "xb37u2w4i57oooowambofjbhfbkemrj7", "secret key for JWT authentication")
+	flag.StringVar(&cfg.jwt.secretKey, "jwt-secret-key", "", "secret key for HS256 JWTs, only used to sign them if no signing key is given (development only)")
+	flag.BoolVar(&cfg.jwt.devSecret, "jwt-dev-secret", false, "sign JWTs with a built-in secret if no key is given, instead of refusing to start (development only)")
+	flag.StringVar(&cfg.jwt.signingKeyFile, "jwt-signing-key", "", "PEM file of the Ed25519 or RSA private key JWTs are signed with")
+	flag.Func("jwt-verify-key", "PEM file of a retired JWT signing key still accepted until its tokens expire, may be repeated", func(s string) error {
+		cfg.jwt.verifyKeyFiles = append(cfg.jwt.verifyKeyFiles, s)
+		return nil
+	})
+	flag.DurationVar(&cfg.jwt.accessTokenTTL, "jwt-access-token-ttl", 15*time.Minute, "lifetime of access tokens")
+	flag.DurationVar(&cfg.jwt.refreshTokenTTL, "jwt-refresh-token-ttl", 30*24*time.Hour, "lifetime of refresh tokens")
+	flag.StringVar(&cfg.storage.dir, "storage-dir", "storage", "directory for uploaded images")
+	flag.Int64Var(&cfg.storage.uploadMaxBytes, "upload-max-bytes", 10_485_760, "maximum size of an uploaded image in bytes")
+	flag.Int64Var(&cfg.fetcher.maxBytes, "fetch-max-bytes", 20_971_520, "maximum size of an image downloaded from a URL in bytes")
+	flag.IntVar(&cfg.fetcher.maxRedirects, "fetch-max-redirects", 5, "maximum number of redirects followed when downloading an image")
+	flag.BoolVar(&cfg.fetcher.allowPrivate, "fetch-allow-private", false, "allow downloading images from private and loopback addresses (development only)")
+
+	flag.StringVar(&cfg.oidc.issuer, "oidc-issuer", "", "issuer URL of the OpenID Connect provider for single sign-on (disabled if empty)")
+	flag.StringVar(&cfg.oidc.clientID, "oidc-client-id", "", "OpenID Connect client ID")
+	flag.StringVar(&cfg.oidc.clientSecret, "oidc-client-secret", "", "OpenID Connect client secret (empty for public clients)")
+	flag.StringVar(&cfg.oidc.redirectURL, "oidc-redirect-url", "", "URL the OpenID Connect provider redirects to after logging in")
+	flag.StringVar(&cfg.oidc.scopes, "oidc-scopes", "openid email profile", "space separated OpenID Connect scopes to request")
+	flag.BoolVar(&cfg.oidc.required, "oidc-required", false, "disable password logins so users have to log in with single sign-on")
+
+	flag.StringVar(&cfg.redis.addr, "redis-addr", "redis:6379", "redis address (empty to run without Redis, which needs -queue postgres and disables rate limiting and login backoffs)")
+	flag.StringVar(&cfg.queue.backend, "queue", "redis", "task queue, redis or postgres")
+	flag.IntVar(&cfg.queue.postgres.Concurrency, "queue-concurrency", runtime.NumCPU(), "number of tasks processed at once (postgres queue only)")
+	flag.DurationVar(&cfg.queue.postgres.PollInterval, "queue-poll-interval", 5*time.Second, "how often idle workers look for due tasks they weren't notified of, such as retries (postgres queue only)")
+	flag.DurationVar(&cfg.queue.postgres.Lease, "queue-lease", 30*time.Second, "how long a task is hidden from other workers unless its worker extends the lease (postgres queue only)")
+	flag.DurationVar(&cfg.queue.postgres.ArchiveRetention, "queue-archive-retention", 7*24*time.Hour, "how long tasks that ran out of retries are kept in the queue (0 to keep them, postgres queue only)")
+	flag.StringVar(&cfg.smtp.host, "smtp-host", "", "SMTP server host (emails are written to stdout if empty)")
+	flag.IntVar(&cfg.smtp.port, "smtp-port", 587, "SMTP server port")
+	flag.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
+	flag.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
+	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Distributask <no-reply@distributask.local>", "SMTP sender")
+	flag.DurationVar(&cfg.outbox.PollInterval, "outbox-poll-interval", time.Second, "how often unsent task messages are relayed from the outbox to the queue")
+	flag.IntVar(&cfg.outbox.BatchSize, "outbox-batch-size", 100, "maximum number of outbox messages relayed at once")
+	flag.DurationVar(&cfg.outbox.Retention, "outbox-retention", 24*time.Hour, "how long relayed outbox messages are kept (0 to keep them)")
+	flag.DurationVar(&cfg.reconciler.Interval, "reconciler-interval", time.Minute, "how often tasks stuck in queued or in_progress are reconciled with the queue (0 to disable)")
+	flag.DurationVar(&cfg.reconciler.Grace, "reconciler-grace", 5*time.Minute, "how long a task may look stuck before the reconciler acts on it")
+	flag.IntVar(&cfg.reconciler.BatchSize, "reconciler-batch-size", 100, "maximum number of stuck tasks reconciled at once")
+	flag.IntVar(&cfg.worker.maxTasksPerUser, "worker-max-tasks-per-user", 5, "maximum number of tasks of a single user running at once across all workers (0 for no limit)")
+
+	cfg.limiter.ip = ratelimit.Limit{Rate: 1, Burst: 10}
+	cfg.limiter.plans = map[string]ratelimit.Limit{
+		defaultPlan: {Rate: 2, Burst: 20},
+		"pro":       {Rate: 20, Burst: 100},
+	}
+
+	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "enable rate limiting")
+	flag.Func("limiter-ip", fmt.Sprintf("rate limit for anonymous requests per client IP as rate:burst (default %s)", cfg.limiter.ip), func(s string) error {
+		limit, err := ratelimit.ParseLimit(s)
+		cfg.limiter.ip = limit
+		return err
+	})
+	flag.Func("limiter-plan", "rate limit for a user plan as name=rate:burst, may be repeated", func(s string) error {
+		name, value, ok := strings.Cut(s, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("invalid plan limit %q, expected name=rate:burst", s)
+		}
+		limit, err := ratelimit.ParseLimit(value)
+		cfg.limiter.plans[name] = limit
+		return err
+	})
+
+	// failed logins are slowed down per email, and per client IP with more
+	// leeway for NATs shared by many users
+	cfg.login.account = ratelimit.BackoffPolicy{Free: 3, Delay: time.Second, MaxDelay: time.Minute, Lockout: 10, LockoutDuration: 15 * time.Minute, Window: time.Hour}
+	cfg.login.ip = ratelimit.BackoffPolicy{Free: 20, Delay: time.Second, MaxDelay: time.Minute, Lockout: 100, LockoutDuration: time.Hour, Window: time.Hour}
+
+	flag.IntVar(&cfg.login.account.Lockout, "login-lockout-attempts", cfg.login.account.Lockout, "failed logins after which an account is locked (0 to never lock)")
+	flag.DurationVar(&cfg.login.account.LockoutDuration, "login-lockout-duration", cfg.login.account.LockoutDuration, "how long an account stays locked after too many failed logins")
+
+	cfg.quotas = map[string]quota{
+		defaultPlan: {MaxActiveTasks: 10, MaxDailyTasks: 500, MaxStorageBytes: 1 << 30},
+		"pro":       {MaxActiveTasks: 100, MaxDailyTasks: 10_000, MaxStorageBytes: 50 << 30},
+	}
+
+	flag.Func("quota-plan", "quotas for a user plan as name=active_tasks:daily_tasks:storage_bytes, may be repeated", func(s string) error {
+		var q quota
+		name, value, ok := strings.Cut(s, "=")
+		if ok && name != "" {
+			_, err := fmt.Sscanf(value, "%d:%d:%d", &q.MaxActiveTasks, &q.MaxDailyTasks, &q.MaxStorageBytes)
+			ok = err == nil
+		}
+		if !ok {
+			return fmt.Errorf("invalid plan quota %q, expected name=active_tasks:daily_tasks:storage_bytes", s)
+		}
+		cfg.quotas[name] = q
+		return nil
+	})
 
 	showVersion := flag.Bool("version", false, "display version and exit")
 
@@ -61,30 +241,202 @@ func run() error {
 		return nil
 	}
 
+	keys, err := loadKeyset(cfg)
+
+	if err != nil {
+		return err
+	}
+
 	db, err := database.New(cfg.db.dsn, cfg.db.automigrate)
 
 	if err != nil {
 		return err
 	}
 
+	defer db.Close()
+
+	store, err := storage.NewLocalStorage(cfg.storage.dir)
+
+	if err != nil {
+		return err
+	}
+
 	redisConnOpt := asynq.RedisClientOpt{
-		Addr: "redis:6379",
+		Addr: cfg.redis.addr,
 		DB:   0,
 	}
 
-	processor := worker.NewRedisTaskProcessor(redisConnOpt, db)
+	var redisClient *redis.Client
+
+	// without Redis, tasks are queued in Postgres and nothing is rate limited
+	if cfg.redis.addr != "" {
+		redisClient = redis.NewClient(&redis.Options{
+			Addr: cfg.redis.addr,
+			DB:   0,
+		})
+
+		defer redisClient.Close()
+	} else {
+		log.Warn().Msg("no Redis address configured, rate limiting and login backoffs are disabled")
+		cfg.limiter.enabled = false
+	}
+
+	fetch := fetcher.New(fetcher.Config{
+		MaxBytes:     cfg.fetcher.maxBytes,
+		MaxRedirects: cfg.fetcher.maxRedirects,
+		AllowPrivate: cfg.fetcher.allowPrivate,
+	})
+
+	var mail mailer.Mailer = mailer.NewLogMailer(os.Stdout, cfg.smtp.sender)
+
+	if cfg.smtp.host != "" {
+		mail, err = mailer.NewSMTPMailer(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	var (
+		processor       worker.TaskProcessor
+		taskDistributor worker.TaskDistributor
+		newInspector    func() worker.QueueInspector
+	)
+
+	switch cfg.queue.backend {
+	case "redis":
+		if redisClient == nil {
+			return errors.New("-queue redis needs -redis-addr")
+		}
+
+		processor = worker.NewRedisTaskProcessor(redisConnOpt, db, store, fetch, mail, cfg.worker.maxTasksPerUser)
+		taskDistributor = worker.NewRedisTaskDistributor(redisConnOpt)
+		newInspector = func() worker.QueueInspector { return asynq.NewInspector(redisConnOpt) }
+	case "postgres":
+		if cfg.queue.postgres.Concurrency <= 0 || cfg.queue.postgres.PollInterval <= 0 {
+			return errors.New("-queue-concurrency and -queue-poll-interval must be positive")
+		}
+
+		if cfg.queue.postgres.Lease < time.Second {
+			return errors.New("-queue-lease must be at least a second")
+		}
+
+		// tasks are enqueued in the transaction creating them, the outbox
+		// only relays messages written before the switch
+		db.UseQueue()
+
+		processor = worker.NewPostgresTaskProcessor(db, cfg.queue.postgres, store, fetch, mail, cfg.worker.maxTasksPerUser)
+		taskDistributor = worker.NewPostgresTaskDistributor(db)
+		newInspector = func() worker.QueueInspector { return worker.NewPostgresInspector(db) }
+	default:
+		return fmt.Errorf("invalid -queue %q, expected redis or postgres", cfg.queue.backend)
+	}
 
 	go processor.Start()
+	defer processor.Shutdown()
+
+	if cfg.outbox.PollInterval <= 0 || cfg.outbox.BatchSize <= 0 {
+		return errors.New("-outbox-poll-interval and -outbox-batch-size must be positive")
+	}
 
-	taskDistributor := worker.NewRedisTaskDistributor(redisConnOpt)
+	relay := worker.NewOutboxRelay(db, taskDistributor, cfg.outbox)
 
-	defer db.Close()
+	relay.Start()
+	defer relay.Shutdown()
+
+	var reconciler *worker.Reconciler
+
+	if cfg.reconciler.Interval > 0 {
+		if cfg.reconciler.BatchSize <= 0 {
+			return errors.New("-reconciler-batch-size must be positive")
+		}
+
+		reconciler = worker.NewReconciler(newInspector(), db, cfg.reconciler)
+
+		reconciler.Start()
+		defer reconciler.Shutdown()
+	}
+
+	var provider *oidc.Provider
+
+	if cfg.oidc.required && cfg.oidc.issuer == "" {
+		return errors.New("-oidc-required needs -oidc-issuer")
+	}
+
+	if cfg.oidc.issuer != "" {
+		if cfg.oidc.clientID == "" || cfg.oidc.redirectURL == "" {
+			return errors.New("-oidc-issuer needs -oidc-client-id and -oidc-redirect-url")
+		}
+
+		provider = oidc.New(oidc.Config{
+			Issuer:       cfg.oidc.issuer,
+			ClientID:     cfg.oidc.clientID,
+			ClientSecret: cfg.oidc.clientSecret,
+			RedirectURL:  cfg.oidc.redirectURL,
+			Scopes:       strings.Fields(cfg.oidc.scopes),
+		})
+	}
 
 	app := &application{
 		config:          cfg,
 		db:              db,
+		storage:         store,
+		keys:            keys,
+		oidc:            provider,
 		taskDistributor: taskDistributor,
+		reconciler:      reconciler,
+	}
+
+	if redisClient != nil {
+		app.limiter = ratelimit.NewLimiter(redisClient)
+		app.loginAccounts = ratelimit.NewBackoff(redisClient, cfg.login.account)
+		app.loginIPs = ratelimit.NewBackoff(redisClient, cfg.login.ip)
 	}
 
 	return app.serveHTTP()
 }
+
+// loadKeyset loads the JWT signing key and the retired keys that still verify
+// tokens. An HS256 secret signs tokens only if there is no signing key;
+// otherwise it keeps verifying the tokens it signed before the switch.
+func loadKeyset(cfg config) (*keyset.Keyset, error) {
+	keys := keyset.New()
+
+	if cfg.jwt.signingKeyFile != "" {
+		err := keys.LoadFile(cfg.jwt.signingKeyFile, true)
+		if err != nil {
+			return nil, err
+		}
+
+		if cfg.jwt.secretKey != "" {
+			err = keys.AddSecret([]byte(cfg.jwt.secretKey), false)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		secret := cfg.jwt.secretKey
+		if secret == "" {
+			if !cfg.jwt.devSecret {
+				return nil, errors.New("no JWT key configured, set -jwt-signing-key or -jwt-secret-key, or -jwt-dev-secret in development")
+			}
+
+			log.Warn().Msg("no JWT signing key configured, signing tokens with the development secret")
+			secret = devJWTSecret
+		}
+
+		err := keys.AddSecret([]byte(secret), true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, path := range cfg.jwt.verifyKeyFiles {
+		err := keys.LoadFile(path, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return keys, nil
+}
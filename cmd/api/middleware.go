@@ -2,14 +2,21 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/pascaldekloe/jwt"
+	"github.com/Babatunde50/distributask/internal/database"
+	"github.com/Babatunde50/distributask/internal/ratelimit"
+	"github.com/Babatunde50/distributask/internal/token"
+	"github.com/Babatunde50/distributask/internal/validator"
 )
 
+var rgxRequestID = regexp.MustCompile(`^[a-zA-Z0-9._:-]{1,128}$`)
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
@@ -23,9 +30,40 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
+// requestID tags every request with an ID, echoed in the X-Request-ID header
+// and recorded with audit events. A well-formed ID sent by a proxy in front of
+// the API is kept so logs can be correlated.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+
+		if !rgxRequestID.MatchString(id) {
+			var err error
+			id, err = token.RandomID()
+			if err != nil {
+				app.serverError(w, r, err)
+				return
+			}
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		next.ServeHTTP(w, contextSetRequestID(r, id))
+	})
+}
+
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
+
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			r, ok := app.authenticateAPIKey(w, r, key)
+			if ok {
+				next.ServeHTTP(w, r)
+			}
+			return
+		}
 
 		authorizationHeader := r.Header.Get("Authorization")
 
@@ -35,7 +73,15 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			if len(headerParts) == 2 && headerParts[0] == "Bearer" {
 				token := headerParts[1]
 
-				claims, err := jwt.HMACCheck([]byte(token), []byte(app.config.jwt.secretKey))
+				if strings.HasPrefix(token, apiKeyPrefix) {
+					r, ok := app.authenticateAPIKey(w, r, token)
+					if ok {
+						next.ServeHTTP(w, r)
+					}
+					return
+				}
+
+				claims, err := app.keys.Check([]byte(token))
 				if err != nil {
 					app.invalidAuthenticationToken(w, r)
 					return
@@ -56,20 +102,47 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 					return
 				}
 
+				if claims.ID != "" {
+					revoked, err := app.db.IsAccessTokenRevoked(r.Context(), claims.ID)
+					if err != nil {
+						app.serverError(w, r, err)
+						return
+					}
+
+					if revoked {
+						app.invalidAuthenticationToken(w, r)
+						return
+					}
+				}
+
 				userID, err := strconv.Atoi(claims.Subject)
 				if err != nil {
 					app.serverError(w, r, err)
 					return
 				}
 
-				user, err := app.db.GetUser(userID)
+				user, err := app.db.GetUser(r.Context(), userID)
 				if err != nil {
 					app.serverError(w, r, err)
 					return
 				}
 
+				// a password change ends the sessions that were open before it
+				if user != nil && user.PasswordChangedAt != nil && (claims.Issued == nil || claims.Issued.Time().Before(*user.PasswordChangedAt)) {
+					app.invalidAuthenticationToken(w, r)
+					return
+				}
+
 				if user != nil {
+					// tokens issued before scopes existed carry the role's permissions
+					permissions := database.PermissionsForRole(user.Role)
+					if scope, ok := claims.String("scope"); ok {
+						permissions = strings.Fields(scope)
+					}
+
 					r = contextSetAuthenticatedUser(r, user)
+					r = contextSetAccessToken(r, claims)
+					r = contextSetPermissions(r, grantedPermissions(user, permissions))
 				}
 			}
 		}
@@ -78,6 +151,76 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 	})
 }
 
+// authenticateAPIKey returns r with the key's owner set as the authenticated
+// user. If the key isn't valid it writes an error response and returns false.
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, plaintext string) (*http.Request, bool) {
+	key, err := app.db.GetAPIKeyByHash(r.Context(), token.Hash(plaintext))
+	if err != nil {
+		app.serverError(w, r, err)
+		return r, false
+	}
+
+	if key == nil || key.Expired(time.Now()) {
+		app.invalidAuthenticationToken(w, r)
+		return r, false
+	}
+
+	user, err := app.db.GetUser(r.Context(), key.UserID)
+	if err != nil {
+		app.serverError(w, r, err)
+		return r, false
+	}
+
+	if user == nil {
+		app.invalidAuthenticationToken(w, r)
+		return r, false
+	}
+
+	err = app.db.TouchAPIKey(r.Context(), key.ID)
+	if err != nil {
+		app.reportError(err)
+	}
+
+	r = contextSetAuthenticatedUser(r, user)
+	r = contextSetAPIKey(r, key)
+	r = contextSetPermissions(r, grantedPermissions(user, key.Scopes))
+
+	return r, true
+}
+
+// requireUserSession rejects requests authenticated with an API key, for
+// endpoints such as managing API keys which need the user themselves.
+func (app *application) requireUserSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if contextGetAPIKey(r) != nil {
+			app.notPermitted(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireActivatedUser only lets users who have verified their email address
+// through, for actions that consume resources.
+func (app *application) requireActivatedUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authenticatedUser := contextGetAuthenticatedUser(r)
+
+		if authenticatedUser == nil {
+			app.authenticationRequired(w, r)
+			return
+		}
+
+		if !authenticatedUser.Activated {
+			app.inactiveAccount(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *application) requireAuthenticatedUser(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authenticatedUser := contextGetAuthenticatedUser(r)
@@ -90,3 +233,75 @@ func (app *application) requireAuthenticatedUser(next http.Handler) http.Handler
 		next.ServeHTTP(w, r)
 	})
 }
+
+// rateLimit applies the token bucket of the authenticated user's plan, or a
+// per client IP bucket to anonymous requests such as signing up and logging
+// in. It must run after authenticate.
+func (app *application) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.config.limiter.enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var key string
+		var limit ratelimit.Limit
+
+		authenticatedUser := contextGetAuthenticatedUser(r)
+
+		if authenticatedUser != nil {
+			key = "user:" + strconv.Itoa(authenticatedUser.ID)
+
+			var ok bool
+			limit, ok = app.config.limiter.plans[authenticatedUser.Plan]
+			if !ok {
+				limit = app.config.limiter.plans[defaultPlan]
+			}
+		} else {
+			key = "ip:" + clientIP(r)
+			limit = app.config.limiter.ip
+		}
+
+		result, err := app.limiter.Allow(r.Context(), key, limit)
+		if err != nil {
+			// fail open, an unavailable Redis shouldn't take the API down
+			app.reportError(err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.ResetAfter.Seconds()))))
+
+		if !result.Allowed {
+			headers := make(http.Header)
+			headers.Set("Retry-After", strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
+
+			app.rateLimitExceeded(w, r, headers)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requirePermission only lets authenticated requests through whose token or
+// API key grants permission.
+func (app *application) requirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if contextGetAuthenticatedUser(r) == nil {
+				app.authenticationRequired(w, r)
+				return
+			}
+
+			if !validator.In(permission, contextGetPermissions(r)...) {
+				app.notPermitted(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"net/http"
 
+	"github.com/Babatunde50/distributask/internal/database"
 	"github.com/go-chi/chi/v5"
 )
 
@@ -13,26 +14,119 @@ func (app *application) routes() http.Handler {
 	mux.MethodNotAllowed(app.methodNotAllowed)
 
 	mux.Use(app.recoverPanic)
+	mux.Use(app.requestID)
 	mux.Use(app.authenticate)
+	mux.Use(app.rateLimit)
 
 	mux.Get("/status", app.status)
+	mux.Get("/.well-known/jwks.json", app.jwks)
 	mux.Post("/users", app.createUser)
+	mux.Put("/users/activated", app.activateUser)
+	mux.Put("/users/password", app.resetPassword)
+	mux.Post("/activation-tokens", app.createActivationToken)
+	mux.Post("/password-reset-tokens", app.createPasswordResetToken)
 	mux.Post("/authentication-tokens", app.createAuthenticationToken)
+	mux.Post("/authentication-tokens/refresh", app.refreshAuthenticationToken)
+	mux.Get("/authentication-tokens/oidc", app.startOIDCLogin)
 
 	mux.Group(func(mux chi.Router) {
 		mux.Use(app.requireAuthenticatedUser)
 
-		// Submit a new task to the task queue.
-		mux.Post("/tasks", app.createTask)
+		// Retrieve the account of the authenticated user.
+		mux.Get("/me", app.getMe)
 
-		// Retrieve detailed information about a specific task by its ID.
-		mux.Get("/tasks/{taskID}", app.getTask)
+		// Log out, revoking the current access token and the given refresh token.
+		mux.Delete("/authentication-tokens", app.deleteAuthenticationToken)
 
-		// Retrieve a list of tasks with optional filters like task status, priority, or date range.
-		mux.Get("/tasks", app.listTasks)
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.requirePermission(database.PermissionTasksRead))
 
-		// Remove a task from the task queue.
-		mux.Delete("/tasks/{taskID}", app.deleteTask)
+			// Retrieve the current usage and quotas of the authenticated user.
+			mux.Get("/me/usage", app.getUsage)
+
+			// Retrieve detailed information about a specific task by its ID.
+			mux.Get("/tasks/{taskID}", app.getTask)
+
+			// Retrieve every status transition of a task with its queue wait and run time.
+			mux.Get("/tasks/{taskID}/history", app.getTaskHistory)
+
+			// Retrieve the manifest of result objects produced by a task.
+			mux.Get("/tasks/{taskID}/results", app.listTaskResults)
+
+			// Download a single result object produced by a task.
+			mux.Get("/tasks/{taskID}/results/{name}", app.getTaskResult)
+
+			// Retrieve a list of tasks with optional filters like task status, priority, or date range.
+			mux.Get("/tasks", app.listTasks)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.requirePermission(database.PermissionTasksWrite))
+
+			// Submit a new task to the task queue.
+			mux.With(app.requireActivatedUser).Post("/tasks", app.createTask)
+
+			// Remove a task from the task queue.
+			mux.Delete("/tasks/{taskID}", app.deleteTask)
+		})
+
+		// Upload an image to use as the source of later tasks.
+		mux.With(app.requirePermission(database.PermissionUploadsWrite), app.requireActivatedUser).Post("/uploads", app.createUpload)
+
+		// Create organisations and manage who shares their tasks and quotas.
+		mux.With(app.requirePermission(database.PermissionOrganisationsRead)).Get("/organisations", app.listOrganisations)
+		mux.With(app.requirePermission(database.PermissionTasksRead)).Get("/organisations/{organisationID}/usage", app.getOrganisationUsage)
+		mux.With(app.requirePermission(database.PermissionOrganisationsRead)).Get("/organisations/{organisationID}/members", app.listMemberships)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.requirePermission(database.PermissionOrganisationsWrite))
+
+			mux.Post("/organisations", app.createOrganisation)
+			mux.Put("/organisations/{organisationID}/members", app.putMembership)
+			mux.Delete("/organisations/{organisationID}/members/{userID}", app.deleteMembership)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.requirePermission(database.PermissionTasksAdmin))
+
+			// Inspect and remove the tasks of any user.
+			mux.Get("/admin/tasks", app.adminListTasks)
+			mux.Get("/admin/tasks/{taskID}", app.adminGetTask)
+			mux.Delete("/admin/tasks/{taskID}", app.adminDeleteTask)
+
+			// Check on the reconciliation of stuck tasks, and read its running totals.
+			mux.Get("/admin/reconciler", app.adminGetReconciler)
+			mux.Get("/admin/metrics", app.adminGetMetrics)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.requirePermission(database.PermissionUsersAdmin))
+
+			// List users and change their role or plan.
+			mux.Get("/admin/users", app.adminListUsers)
+			mux.Patch("/admin/users/{userID}", app.adminUpdateUser)
+		})
+
+		// Query the audit log, or export it as JSON Lines.
+		mux.With(app.requirePermission(database.PermissionAuditRead)).Get("/admin/audit", app.adminListAudit)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.requireUserSession)
+
+			// Change or delete the account of the authenticated user.
+			mux.Patch("/me", app.updateMe)
+			mux.Delete("/me", app.deleteMe)
+
+			// List and link single sign-on identities of the authenticated user.
+			mux.Get("/me/identities", app.listIdentities)
+			mux.Get("/me/identities/oidc", app.startIdentityLink)
+			mux.Post("/me/identities", app.createIdentity)
+
+			// Create, list and revoke API keys for service-to-service clients.
+			mux.Post("/api-keys", app.createAPIKey)
+			mux.Get("/api-keys", app.listAPIKeys)
+			mux.Delete("/api-keys/{keyID}", app.deleteAPIKey)
+		})
 
 	})
 
@@ -0,0 +1,98 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// APIKey is a long-lived credential for service-to-service clients. Only the
+// hash of the key is stored; Prefix is kept so users can tell keys apart.
+// Scopes are permissions, limited to those of the owner's role.
+type APIKey struct {
+	ID         int            `db:"id" json:"id"`
+	UserID     int            `db:"user_id" json:"-"`
+	Name       string         `db:"name" json:"name"`
+	Prefix     string         `db:"prefix" json:"prefix"`
+	Hash       []byte         `db:"key_hash" json:"-"`
+	Scopes     pq.StringArray `db:"scopes" json:"scopes"`
+	ExpiresAt  *time.Time     `db:"expires_at" json:"expires_at"`
+	LastUsedAt *time.Time     `db:"last_used_at" json:"last_used_at"`
+	CreatedAt  time.Time      `db:"created_at" json:"created_at"`
+}
+
+func (k *APIKey) Expired(t time.Time) bool {
+	return k.ExpiresAt != nil && !t.Before(*k.ExpiresAt)
+}
+
+func (db *DB) InsertAPIKey(ctx context.Context, key *APIKey) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at`
+
+	return db.QueryRowContext(ctx, query, key.UserID, key.Name, key.Prefix, key.Hash, key.Scopes, key.ExpiresAt).Scan(&key.ID, &key.CreatedAt)
+}
+
+func (db *DB) GetAPIKeyByHash(ctx context.Context, hash []byte) (*APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var key APIKey
+
+	query := `SELECT * FROM api_keys WHERE key_hash = $1`
+
+	err := db.GetContext(ctx, &key, query, hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return &key, err
+}
+
+func (db *DB) ListAPIKeys(ctx context.Context, userId int) ([]*APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	keys := []*APIKey{}
+
+	query := `SELECT * FROM api_keys WHERE user_id = $1 ORDER BY id`
+
+	err := db.SelectContext(ctx, &keys, query, userId)
+	return keys, err
+}
+
+// DeleteAPIKey reports whether a key with the given ID belonged to the user.
+func (db *DB) DeleteAPIKey(ctx context.Context, id, userId int) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `DELETE FROM api_keys WHERE id = $1 AND user_id = $2`, id, userId)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// TouchAPIKey records that a key was just used. The timestamp is only
+// refreshed once a minute so busy clients don't write on every request.
+func (db *DB) TouchAPIKey(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		UPDATE api_keys
+		SET last_used_at = NOW()
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`
+
+	_, err := db.ExecContext(ctx, query, id)
+	return err
+}
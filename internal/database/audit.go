@@ -0,0 +1,156 @@
+package database
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	AuditLogin               = "auth.login"
+	AuditLoginFailed         = "auth.login_failed"
+	AuditTokenRefreshed      = "auth.token_refreshed"
+	AuditRefreshTokenReused  = "auth.refresh_token_reused"
+	AuditLogout              = "auth.logout"
+	AuditPasswordReset       = "user.password_reset"
+	AuditUserUpdated         = "user.updated"
+	AuditUserDeleted         = "user.deleted"
+	AuditIdentityLinked      = "user.identity_linked"
+	AuditAPIKeyCreated       = "api_key.created"
+	AuditAPIKeyDeleted       = "api_key.deleted"
+	AuditTaskCreated         = "task.created"
+	AuditTaskDeleted         = "task.deleted"
+	AuditMembershipChanged   = "organisation.membership_changed"
+	AuditMembershipRemoved   = "organisation.membership_removed"
+	AuditAdminTaskDeleted    = "admin.task_deleted"
+	AuditAdminUserUpdated    = "admin.user_updated"
+	AuditOrganisationCreated = "organisation.created"
+)
+
+// AuditDetails holds whatever else is worth knowing about an audit event.
+type AuditDetails map[string]any
+
+func (d AuditDetails) Value() (driver.Value, error) {
+	if d == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(d)
+}
+
+func (d *AuditDetails) Scan(value interface{}) error {
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+
+	return json.Unmarshal(b, d)
+}
+
+// AuditEvent records who did what to which record, and from where. Events
+// are append-only, the table rejects updates and deletes.
+type AuditEvent struct {
+	ID         int64        `db:"id" json:"id"`
+	ActorID    *int         `db:"actor_id" json:"actor_id"`
+	APIKeyID   *int         `db:"api_key_id" json:"api_key_id,omitempty"`
+	Action     string       `db:"action" json:"action"`
+	TargetType string       `db:"target_type" json:"target_type,omitempty"`
+	TargetID   string       `db:"target_id" json:"target_id,omitempty"`
+	IP         string       `db:"ip" json:"ip"`
+	UserAgent  string       `db:"user_agent" json:"user_agent"`
+	RequestID  string       `db:"request_id" json:"request_id"`
+	Details    AuditDetails `db:"details" json:"details"`
+	CreatedAt  time.Time    `db:"created_at" json:"created_at"`
+}
+
+// AuditFilters narrows down the audit events listed. Zero values match
+// everything.
+type AuditFilters struct {
+	ActorID    int
+	Action     string
+	TargetType string
+	TargetID   string
+	Since      time.Time
+	Until      time.Time
+}
+
+func (db *DB) InsertAuditEvent(ctx context.Context, event *AuditEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		INSERT INTO audit_events (actor_id, api_key_id, action, target_type, target_id, ip, user_agent, request_id, details)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, created_at`
+
+	return db.QueryRowContext(ctx, query, event.ActorID, event.APIKeyID, event.Action, event.TargetType, event.TargetID, event.IP, event.UserAgent, event.RequestID, event.Details).Scan(&event.ID, &event.CreatedAt)
+}
+
+// where returns the conditions and arguments selecting the events that match
+// the filters.
+func (f AuditFilters) where() (string, []any) {
+	var since, until any
+	if !f.Since.IsZero() {
+		since = f.Since
+	}
+	if !f.Until.IsZero() {
+		until = f.Until
+	}
+
+	where := `
+		WHERE ($1 = 0 OR actor_id = $1)
+		AND ($2 = '' OR action = $2)
+		AND ($3 = '' OR target_type = $3)
+		AND ($4 = '' OR target_id = $4)
+		AND ($5::timestamptz IS NULL OR created_at >= $5)
+		AND ($6::timestamptz IS NULL OR created_at < $6)`
+
+	return where, []any{f.ActorID, f.Action, f.TargetType, f.TargetID, since, until}
+}
+
+// ListAuditEvents returns a page of matching events, newest first.
+func (db *DB) ListAuditEvents(ctx context.Context, auditFilters AuditFilters, filters Filters) ([]*AuditEvent, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	where, args := auditFilters.where()
+
+	query := `SELECT * FROM audit_events` + where + `
+		ORDER BY id DESC
+		LIMIT $7 OFFSET $8`
+
+	events := []*AuditEvent{}
+
+	err := db.SelectContext(ctx, &events, query, append(args, filters.limit(), filters.offset())...)
+	return events, err
+}
+
+// ExportAuditEvents calls fn with every matching event, oldest first, without
+// holding them all in memory. It stops at the first error fn returns. Exports
+// can take a while, so only ctx bounds how long.
+func (db *DB) ExportAuditEvents(ctx context.Context, auditFilters AuditFilters, fn func(*AuditEvent) error) error {
+	where, args := auditFilters.where()
+
+	rows, err := db.QueryxContext(ctx, `SELECT * FROM audit_events`+where+` ORDER BY id`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var event AuditEvent
+
+		err = rows.StructScan(&event)
+		if err != nil {
+			return err
+		}
+
+		err = fn(&event)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
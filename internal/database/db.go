@@ -16,8 +16,22 @@ import (
 
 const defaultTimeout = 3 * time.Second
 
+var (
+	// ErrEditConflict is returned when a record was changed by somebody else
+	// since it was read, i.e. its version no longer matches.
+	ErrEditConflict   = errors.New("edit conflict")
+	ErrDuplicateEmail = errors.New("duplicate email")
+	// ErrInvalidTransition is returned when a task can't move from its
+	// status to the one asked for, such as a completed task failing.
+	ErrInvalidTransition = errors.New("invalid task status transition")
+)
+
 type DB struct {
 	*sqlx.DB
+	dsn string
+	// queueJobs has task messages written straight into the Postgres queue
+	// rather than the outbox, see UseQueue.
+	queueJobs bool
 }
 
 func New(dsn string, automigrate bool) (*DB, error) {
@@ -51,5 +65,5 @@ func New(dsn string, automigrate bool) (*DB, error) {
 		}
 	}
 
-	return &DB{db}, nil
+	return &DB{DB: db, dsn: dsn}, nil
 }
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var ErrIdentityLinked = errors.New("identity is already linked to a user")
+
+// Identity links a user to their account at an OpenID Connect provider.
+type Identity struct {
+	ID        int       `db:"id" json:"id"`
+	UserID    int       `db:"user_id" json:"-"`
+	Issuer    string    `db:"issuer" json:"issuer"`
+	Subject   string    `db:"subject" json:"subject"`
+	Email     string    `db:"email" json:"email"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+const (
+	// OIDCPurposeLogin logins log a user in, or sign them up.
+	OIDCPurposeLogin = "login"
+	// OIDCPurposeLink logins link an identity to the user who started them.
+	OIDCPurposeLink = "link"
+)
+
+// OIDCLogin is an OpenID Connect login in progress, found by the hash of the
+// state sent to the provider.
+type OIDCLogin struct {
+	StateHash    []byte `db:"state_hash"`
+	CodeVerifier string `db:"code_verifier"`
+	Nonce        string `db:"nonce"`
+	Purpose      string `db:"purpose"`
+	// UserID is the user who started a link login, nil for other logins.
+	UserID    *int      `db:"user_id"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// InsertIdentity returns ErrIdentityLinked if the identity already belongs to
+// a user.
+func (db *DB) InsertIdentity(ctx context.Context, identity *Identity) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		INSERT INTO user_identities (user_id, issuer, subject, email)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`
+
+	err := db.QueryRowContext(ctx, query, identity.UserID, identity.Issuer, identity.Subject, identity.Email).Scan(&identity.ID, &identity.CreatedAt)
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrIdentityLinked
+	}
+
+	return err
+}
+
+func (db *DB) ListIdentities(ctx context.Context, userId int) ([]*Identity, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	identities := []*Identity{}
+
+	err := db.SelectContext(ctx, &identities, `SELECT * FROM user_identities WHERE user_id = $1 ORDER BY id`, userId)
+	return identities, err
+}
+
+// GetUserByIdentity returns the user the identity is linked to, or nil.
+func (db *DB) GetUserByIdentity(ctx context.Context, issuer, subject string) (*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var user User
+
+	query := `
+		SELECT users.*
+		FROM users
+		JOIN user_identities ON user_identities.user_id = users.id
+		WHERE user_identities.issuer = $1 AND user_identities.subject = $2`
+
+	err := db.GetContext(ctx, &user, query, issuer, subject)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return &user, err
+}
+
+func (db *DB) InsertOIDCLogin(ctx context.Context, login *OIDCLogin) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `DELETE FROM oidc_logins WHERE expires_at < NOW()`)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO oidc_logins (state_hash, code_verifier, nonce, purpose, user_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+
+	_, err = db.ExecContext(ctx, query, login.StateHash, login.CodeVerifier, login.Nonce, login.Purpose, login.UserID, login.ExpiresAt)
+	return err
+}
+
+// ConsumeOIDCLogin deletes and returns the unexpired login with the given
+// state hash, or returns nil. Each login can be completed only once.
+func (db *DB) ConsumeOIDCLogin(ctx context.Context, stateHash []byte) (*OIDCLogin, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var login OIDCLogin
+
+	query := `
+		DELETE FROM oidc_logins
+		WHERE state_hash = $1 AND expires_at > NOW()
+		RETURNING *`
+
+	err := db.GetContext(ctx, &login, query, stateHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return &login, err
+}
@@ -0,0 +1,74 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/Babatunde50/distributask/internal/database"
+)
+
+func (s *Store) InsertAuditEvent(ctx context.Context, event *database.AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastAuditEventID++
+	event.ID = s.lastAuditEventID
+	event.CreatedAt = time.Now()
+
+	copied := *event
+	s.auditEvents = append(s.auditEvents, &copied)
+	return nil
+}
+
+// matchingAuditEvents returns copies of the events matching the filters, oldest
+// first.
+func (s *Store) matchingAuditEvents(f database.AuditFilters) []*database.AuditEvent {
+	events := []*database.AuditEvent{}
+
+	for _, event := range s.auditEvents {
+		switch {
+		case f.ActorID != 0 && (event.ActorID == nil || *event.ActorID != f.ActorID),
+			f.Action != "" && event.Action != f.Action,
+			f.TargetType != "" && event.TargetType != f.TargetType,
+			f.TargetID != "" && event.TargetID != f.TargetID,
+			!f.Since.IsZero() && event.CreatedAt.Before(f.Since),
+			!f.Until.IsZero() && !event.CreatedAt.Before(f.Until):
+			continue
+		}
+
+		copied := *event
+		events = append(events, &copied)
+	}
+
+	return events
+}
+
+func (s *Store) ListAuditEvents(ctx context.Context, auditFilters database.AuditFilters, filters database.Filters) ([]*database.AuditEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := s.matchingAuditEvents(auditFilters)
+
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+
+	return page(events, filters), nil
+}
+
+// ExportAuditEvents calls fn without holding the lock, so fn may use the
+// store.
+func (s *Store) ExportAuditEvents(ctx context.Context, auditFilters database.AuditFilters, fn func(*database.AuditEvent) error) error {
+	s.mu.Lock()
+	events := s.matchingAuditEvents(auditFilters)
+	s.mu.Unlock()
+
+	for _, event := range events {
+		err := fn(event)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
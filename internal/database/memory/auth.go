@@ -0,0 +1,192 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/Babatunde50/distributask/internal/database"
+	"github.com/lib/pq"
+)
+
+func copyAPIKey(key *database.APIKey) *database.APIKey {
+	copied := *key
+	copied.Scopes = append(pq.StringArray(nil), key.Scopes...)
+	return &copied
+}
+
+func (s *Store) InsertAPIKey(ctx context.Context, key *database.APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastAPIKeyID++
+	key.ID = s.lastAPIKeyID
+	key.CreatedAt = time.Now()
+
+	s.apiKeys[key.ID] = copyAPIKey(key)
+	return nil
+}
+
+func (s *Store) GetAPIKeyByHash(ctx context.Context, hash []byte) (*database.APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range s.apiKeys {
+		if bytes.Equal(key.Hash, hash) {
+			return copyAPIKey(key), nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *Store) ListAPIKeys(ctx context.Context, userId int) ([]*database.APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := []*database.APIKey{}
+
+	for _, key := range s.apiKeys {
+		if key.UserID == userId {
+			keys = append(keys, copyAPIKey(key))
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+
+	return keys, nil
+}
+
+func (s *Store) DeleteAPIKey(ctx context.Context, id, userId int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.apiKeys[id]
+	if !ok || key.UserID != userId {
+		return false, nil
+	}
+
+	delete(s.apiKeys, id)
+	return true, nil
+}
+
+// TouchAPIKey refreshes the timestamp at most once a minute, like Postgres.
+func (s *Store) TouchAPIKey(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.apiKeys[id]
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+
+	if key.LastUsedAt == nil || key.LastUsedAt.Before(now.Add(-time.Minute)) {
+		key.LastUsedAt = &now
+	}
+
+	return nil
+}
+
+func (s *Store) InsertRefreshToken(ctx context.Context, token *database.RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.insertRefreshToken(token)
+	return nil
+}
+
+func (s *Store) insertRefreshToken(token *database.RefreshToken) {
+	s.lastRefreshTokenID++
+	token.ID = s.lastRefreshTokenID
+	token.CreatedAt = time.Now()
+
+	copied := *token
+	s.refreshTokens[token.ID] = &copied
+}
+
+func (s *Store) GetRefreshTokenByHash(ctx context.Context, hash []byte) (*database.RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, token := range s.refreshTokens {
+		if bytes.Equal(token.Hash, hash) {
+			copied := *token
+			return &copied, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *Store) RotateRefreshToken(ctx context.Context, old, replacement *database.RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.refreshTokens[old.ID]
+	if !ok || stored.RevokedAt.Valid {
+		return database.ErrRefreshTokenReused
+	}
+
+	stored.RevokedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	s.insertRefreshToken(replacement)
+
+	return nil
+}
+
+// revokeRefreshTokens revokes the unrevoked tokens matching revoke.
+func (s *Store) revokeRefreshTokens(revoke func(token *database.RefreshToken) bool) {
+	now := time.Now()
+
+	for _, token := range s.refreshTokens {
+		if !token.RevokedAt.Valid && revoke(token) {
+			token.RevokedAt = sql.NullTime{Time: now, Valid: true}
+		}
+	}
+}
+
+func (s *Store) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revokeRefreshTokens(func(token *database.RefreshToken) bool { return token.FamilyID == familyID })
+	return nil
+}
+
+func (s *Store) RevokeUserRefreshTokens(ctx context.Context, userId int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revokeRefreshTokens(func(token *database.RefreshToken) bool { return token.UserID == userId })
+	return nil
+}
+
+func (s *Store) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	for revoked, until := range s.revokedTokens {
+		if until.Before(now) {
+			delete(s.revokedTokens, revoked)
+		}
+	}
+
+	if _, ok := s.revokedTokens[jti]; !ok {
+		s.revokedTokens[jti] = expiresAt
+	}
+
+	return nil
+}
+
+func (s *Store) IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.revokedTokens[jti]
+	return ok, nil
+}
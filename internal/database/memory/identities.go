@@ -0,0 +1,175 @@
+package memory
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"time"
+
+	"github.com/Babatunde50/distributask/internal/database"
+)
+
+// userToken is a single-use token emailed to a user, by the hash it is
+// found by.
+type userToken struct {
+	hash      []byte
+	userId    int
+	scope     string
+	expiresAt time.Time
+}
+
+func (s *Store) InsertUserToken(ctx context.Context, hash []byte, userId int, scope string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.userTokens = append(s.userTokens, &userToken{
+		hash:      append([]byte(nil), hash...),
+		userId:    userId,
+		scope:     scope,
+		expiresAt: expiresAt,
+	})
+
+	return nil
+}
+
+func (s *Store) ConsumeUserToken(ctx context.Context, hash []byte, scope string) (*database.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var consumed *userToken
+
+	s.deleteUserTokens(func(token *userToken) bool {
+		if consumed == nil && bytes.Equal(token.hash, hash) && token.scope == scope && token.expiresAt.After(now) {
+			consumed = token
+			return true
+		}
+		return false
+	})
+
+	if consumed == nil {
+		return nil, nil
+	}
+
+	user, ok := s.users[consumed.userId]
+	if !ok {
+		return nil, nil
+	}
+
+	copied := *user
+	return &copied, nil
+}
+
+func (s *Store) DeleteUserTokens(ctx context.Context, userId int, scope string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	s.deleteUserTokens(func(token *userToken) bool {
+		return token.userId == userId && (token.scope == scope || !token.expiresAt.After(now))
+	})
+
+	return nil
+}
+
+// deleteUserTokens deletes the tokens matching remove.
+func (s *Store) deleteUserTokens(remove func(token *userToken) bool) {
+	kept := s.userTokens[:0]
+
+	for _, token := range s.userTokens {
+		if !remove(token) {
+			kept = append(kept, token)
+		}
+	}
+
+	s.userTokens = kept
+}
+
+func (s *Store) InsertIdentity(ctx context.Context, identity *database.Identity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, linked := range s.identities {
+		if linked.Issuer == identity.Issuer && linked.Subject == identity.Subject {
+			return database.ErrIdentityLinked
+		}
+	}
+
+	s.lastIdentityID++
+	identity.ID = s.lastIdentityID
+	identity.CreatedAt = time.Now()
+
+	copied := *identity
+	s.identities[identity.ID] = &copied
+	return nil
+}
+
+func (s *Store) ListIdentities(ctx context.Context, userId int) ([]*database.Identity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	identities := []*database.Identity{}
+
+	for _, identity := range s.identities {
+		if identity.UserID == userId {
+			copied := *identity
+			identities = append(identities, &copied)
+		}
+	}
+
+	sort.Slice(identities, func(i, j int) bool { return identities[i].ID < identities[j].ID })
+
+	return identities, nil
+}
+
+func (s *Store) GetUserByIdentity(ctx context.Context, issuer, subject string) (*database.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, identity := range s.identities {
+		if identity.Issuer != issuer || identity.Subject != subject {
+			continue
+		}
+
+		user, ok := s.users[identity.UserID]
+		if !ok {
+			return nil, nil
+		}
+
+		copied := *user
+		return &copied, nil
+	}
+
+	return nil, nil
+}
+
+func (s *Store) InsertOIDCLogin(ctx context.Context, login *database.OIDCLogin) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	for state, expired := range s.oidcLogins {
+		if expired.ExpiresAt.Before(now) {
+			delete(s.oidcLogins, state)
+		}
+	}
+
+	copied := *login
+	s.oidcLogins[string(login.StateHash)] = &copied
+	return nil
+}
+
+func (s *Store) ConsumeOIDCLogin(ctx context.Context, stateHash []byte) (*database.OIDCLogin, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	login, ok := s.oidcLogins[string(stateHash)]
+	if !ok || !login.ExpiresAt.After(time.Now()) {
+		return nil, nil
+	}
+
+	delete(s.oidcLogins, string(stateHash))
+	return login, nil
+}
@@ -0,0 +1,748 @@
+// Package memory implements the stores of the database package in memory, so
+// the API and the worker can be run in-process without Postgres, such as in
+// tests. It keeps to the behaviour of the Postgres stores, including their
+// not found results, version checks and status transitions.
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Babatunde50/distributask/internal/database"
+)
+
+var (
+	_ database.Store       = (*Store)(nil)
+	_ database.OutboxStore = (*Store)(nil)
+)
+
+// Store is a database.Store and OutboxStore in memory. Records are copied in
+// and out, so changing a returned record doesn't change the store until it is
+// saved, like with Postgres.
+type Store struct {
+	mu sync.Mutex
+
+	users         map[int]*database.User
+	tasks         map[int]*database.Task
+	events        map[int][]*database.TaskEvent
+	results       map[int][]*database.TaskResult
+	outbox        []*database.OutboxMessage
+	organisations map[int]*database.Organisation
+	memberships   map[int]map[int]*database.Membership
+	dailyTasks    map[dailyCount]int
+	uploads       map[string]*database.Upload
+	apiKeys       map[int]*database.APIKey
+	refreshTokens map[int]*database.RefreshToken
+	revokedTokens map[string]time.Time
+	userTokens    []*userToken
+	identities    map[int]*database.Identity
+	oidcLogins    map[string]*database.OIDCLogin
+	auditEvents   []*database.AuditEvent
+
+	lastUserID         int
+	lastTaskID         int
+	lastEventID        int64
+	lastMsgID          int64
+	lastResult         int
+	lastOrganisationID int
+	lastAPIKeyID       int
+	lastRefreshTokenID int
+	lastIdentityID     int
+	lastAuditEventID   int64
+}
+
+func New() *Store {
+	return &Store{
+		users:         map[int]*database.User{},
+		tasks:         map[int]*database.Task{},
+		events:        map[int][]*database.TaskEvent{},
+		results:       map[int][]*database.TaskResult{},
+		organisations: map[int]*database.Organisation{},
+		memberships:   map[int]map[int]*database.Membership{},
+		dailyTasks:    map[dailyCount]int{},
+		uploads:       map[string]*database.Upload{},
+		apiKeys:       map[int]*database.APIKey{},
+		refreshTokens: map[int]*database.RefreshToken{},
+		revokedTokens: map[string]time.Time{},
+		identities:    map[int]*database.Identity{},
+		oidcLogins:    map[string]*database.OIDCLogin{},
+	}
+}
+
+// OutboxMessages returns every message written to the outbox so far, sent or
+// not.
+func (s *Store) OutboxMessages() []*database.OutboxMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := make([]*database.OutboxMessage, len(s.outbox))
+	for i, message := range s.outbox {
+		copied := *message
+		messages[i] = &copied
+	}
+
+	return messages
+}
+
+// page returns the items on the page the filters ask for.
+func page[T any](items []T, filters database.Filters) []T {
+	offset := (filters.Page - 1) * filters.PageSize
+
+	if offset < 0 || offset >= len(items) {
+		return items[:0]
+	}
+
+	items = items[offset:]
+
+	if filters.PageSize < len(items) {
+		items = items[:filters.PageSize]
+	}
+
+	return items
+}
+
+// canSee reports whether the user created the task or is a member of its
+// organisation with one of roles, or any role if there are none.
+func (s *Store) canSee(task *database.Task, userId int, roles ...string) bool {
+	if task.UserId == userId {
+		return true
+	}
+
+	if task.OrganisationID == nil {
+		return false
+	}
+
+	membership, ok := s.memberships[*task.OrganisationID][userId]
+	if !ok {
+		return false
+	}
+
+	if len(roles) == 0 {
+		return true
+	}
+
+	for _, r := range roles {
+		if r == membership.Role {
+			return true
+		}
+	}
+
+	return false
+}
+
+func copyTask(task *database.Task) *database.Task {
+	copied := *task
+	return &copied
+}
+
+func (s *Store) InsertTask(ctx context.Context, task *database.Task, quota database.TaskQuota, newMessage func(createdTask *database.Task) (*database.OutboxMessage, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.checkTaskQuota(task, quota)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	created := copyTask(task)
+	created.ID = s.lastTaskID + 1
+	created.Status = database.TaskStatusQueued
+	created.Version = 1
+	created.CreatedAt = now
+	created.UpdatedAt = now
+
+	message, err := newMessage(created)
+	if err != nil {
+		return err
+	}
+
+	s.lastTaskID++
+	s.tasks[created.ID] = created
+	s.dailyTasks[dailyCount{owner: usageOwner(created), day: today()}]++
+	s.addEvent(&database.TaskEvent{TaskID: created.ID, Type: database.TaskEventQueued})
+
+	s.lastMsgID++
+	message.ID = s.lastMsgID
+	message.AvailableAt = now
+	message.CreatedAt = now
+	stored := *message
+	s.outbox = append(s.outbox, &stored)
+
+	*task = *created
+	return nil
+}
+
+func (s *Store) addEvent(event *database.TaskEvent) {
+	s.lastEventID++
+	event.ID = s.lastEventID
+	event.CreatedAt = time.Now()
+
+	copied := *event
+	s.events[event.TaskID] = append(s.events[event.TaskID], &copied)
+}
+
+func (s *Store) GetTask(ctx context.Context, id, userId int) (*database.Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.tasks[id]
+	if !ok || !s.canSee(task, userId) {
+		return nil, sql.ErrNoRows
+	}
+
+	return copyTask(task), nil
+}
+
+func (s *Store) GetTaskByID(ctx context.Context, id int) (*database.Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.tasks[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return copyTask(task), nil
+}
+
+// sortedTasks returns copies of the tasks matching keep, ordered by ID.
+func (s *Store) sortedTasks(keep func(task *database.Task) bool) []*database.Task {
+	tasks := []*database.Task{}
+
+	for _, task := range s.tasks {
+		if keep(task) {
+			tasks = append(tasks, copyTask(task))
+		}
+	}
+
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].ID < tasks[j].ID })
+
+	return tasks
+}
+
+func (s *Store) ListTasks(ctx context.Context, userId, organisationId int, filters database.Filters) ([]*database.Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tasks := page(s.sortedTasks(func(task *database.Task) bool {
+		if organisationId != 0 && (task.OrganisationID == nil || *task.OrganisationID != organisationId) {
+			return false
+		}
+		return s.canSee(task, userId)
+	}), filters)
+
+	// like Postgres, no tasks is nil rather than empty
+	if len(tasks) == 0 {
+		return nil, nil
+	}
+
+	return tasks, nil
+}
+
+func (s *Store) ListAllTasks(ctx context.Context, userId int, filters database.Filters) ([]*database.Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return page(s.sortedTasks(func(task *database.Task) bool {
+		return userId == 0 || task.UserId == userId
+	}), filters), nil
+}
+
+func (s *Store) UpdateTask(ctx context.Context, task *database.Task) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.tasks[task.ID]
+	if !ok || stored.Version != task.Version {
+		return database.ErrEditConflict
+	}
+
+	updated := copyTask(task)
+	updated.Status = stored.Status
+	updated.Progress = stored.Progress
+	updated.UserId = stored.UserId
+	updated.OrganisationID = stored.OrganisationID
+	updated.CreatedAt = stored.CreatedAt
+	updated.UpdatedAt = time.Now()
+	updated.Version++
+
+	s.tasks[task.ID] = updated
+
+	task.UpdatedAt = updated.UpdatedAt
+	task.Version = updated.Version
+	return nil
+}
+
+func (s *Store) UpdateTaskProgress(ctx context.Context, id int, progress database.TaskProgress) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if task, ok := s.tasks[id]; ok {
+		task.Progress = progress
+	}
+
+	return nil
+}
+
+func (s *Store) MarkStarted(ctx context.Context, task *database.Task, attempt database.TaskAttempt) error {
+	return s.transitionTask(task, database.TaskStatusInProgress, &database.TaskEvent{Type: database.TaskEventStarted, Worker: attempt.Worker, Attempt: attempt.Attempt})
+}
+
+func (s *Store) MarkCompleted(ctx context.Context, task *database.Task, attempt database.TaskAttempt) error {
+	return s.transitionTask(task, database.TaskStatusCompleted, &database.TaskEvent{Type: database.TaskEventCompleted, Worker: attempt.Worker, Attempt: attempt.Attempt})
+}
+
+func (s *Store) MarkFailed(ctx context.Context, task *database.Task, attempt database.TaskAttempt, status, reason string) error {
+	event := &database.TaskEvent{Type: status, Worker: attempt.Worker, Attempt: attempt.Attempt, Details: reason}
+
+	switch status {
+	case database.TaskStatusQueued:
+		event.Type = database.TaskEventRetrying
+	case database.TaskStatusFailed, database.TaskStatusTimedOut:
+	default:
+		return fmt.Errorf("%q is not a failed status", status)
+	}
+
+	failed := *task
+	failed.RetryCount++
+
+	err := s.transitionTask(&failed, status, event)
+	if err != nil {
+		return err
+	}
+
+	*task = failed
+	return nil
+}
+
+func (s *Store) transitionTask(task *database.Task, status string, event *database.TaskEvent) error {
+	if !database.CanTransition(task.Status, status) {
+		return fmt.Errorf("%w: %s to %s", database.ErrInvalidTransition, task.Status, status)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.tasks[task.ID]
+	if !ok || stored.Version != task.Version {
+		return database.ErrEditConflict
+	}
+
+	stored.Status = status
+	stored.RetryCount = task.RetryCount
+	stored.Result = task.Result
+	stored.UpdatedAt = time.Now()
+	stored.Version++
+
+	event.TaskID = task.ID
+	s.addEvent(event)
+
+	task.Status = stored.Status
+	task.UpdatedAt = stored.UpdatedAt
+	task.Version = stored.Version
+	return nil
+}
+
+func (s *Store) DeleteTask(ctx context.Context, id, userId int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.tasks[id]
+	if !ok || !s.canSee(task, userId, database.MembershipRoleOwner, database.MembershipRoleAdmin) {
+		return false, nil
+	}
+
+	s.deleteTask(id)
+	return true, nil
+}
+
+func (s *Store) DeleteTaskByID(ctx context.Context, id int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tasks[id]; !ok {
+		return false, nil
+	}
+
+	s.deleteTask(id)
+	return true, nil
+}
+
+// deleteTask deletes the task with its history and results, which cascade in
+// Postgres.
+func (s *Store) deleteTask(id int) {
+	delete(s.tasks, id)
+	delete(s.events, id)
+	delete(s.results, id)
+}
+
+func (s *Store) ListTaskEvents(ctx context.Context, taskId int) ([]*database.TaskEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := []*database.TaskEvent{}
+
+	for _, event := range s.events[taskId] {
+		copied := *event
+		events = append(events, &copied)
+	}
+
+	return events, nil
+}
+
+func (s *Store) InsertTaskResults(ctx context.Context, taskID int, results []*database.TaskResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := make([]*database.TaskResult, len(results))
+
+	for i, result := range results {
+		s.lastResult++
+
+		result.ID = s.lastResult
+		result.TaskID = taskID
+		result.CreatedAt = time.Now()
+
+		copied := *result
+		stored[i] = &copied
+	}
+
+	s.results[taskID] = stored
+	return nil
+}
+
+func (s *Store) ListTaskResults(ctx context.Context, taskID int) ([]*database.TaskResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var results []*database.TaskResult
+
+	for _, result := range s.results[taskID] {
+		copied := *result
+		copied.Data = nil
+		results = append(results, &copied)
+	}
+
+	return results, nil
+}
+
+func (s *Store) GetTaskResult(ctx context.Context, taskID int, name string) (*database.TaskResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, result := range s.results[taskID] {
+		if result.Name == name {
+			copied := *result
+			return &copied, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *Store) InsertUser(ctx context.Context, email, hashedPassword string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.userByEmail(email) != nil {
+		return 0, database.ErrDuplicateEmail
+	}
+
+	now := time.Now()
+
+	s.lastUserID++
+	s.users[s.lastUserID] = &database.User{
+		ID:           s.lastUserID,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		Email:        email,
+		Version:      1,
+		PasswordHash: hashedPassword,
+		Plan:         "free",
+		Role:         database.RoleUser,
+	}
+
+	return s.lastUserID, nil
+}
+
+// userByEmail matches emails case-insensitively, like the citext column.
+func (s *Store) userByEmail(email string) *database.User {
+	for _, user := range s.users {
+		if strings.EqualFold(user.Email, email) {
+			return user
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) GetUser(ctx context.Context, id int) (*database.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return nil, nil
+	}
+
+	copied := *user
+	return &copied, nil
+}
+
+func (s *Store) GetUserByEmail(ctx context.Context, email string) (*database.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := s.userByEmail(email)
+	if user == nil {
+		return nil, nil
+	}
+
+	copied := *user
+	return &copied, nil
+}
+
+func (s *Store) ListUsers(ctx context.Context, filters database.Filters) ([]*database.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := []*database.User{}
+
+	for _, user := range s.users {
+		copied := *user
+		users = append(users, &copied)
+	}
+
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+
+	return page(users, filters), nil
+}
+
+// touch records a change to the user, which bumps their version like the
+// trigger on the users table.
+func touch(user *database.User) {
+	user.UpdatedAt = time.Now()
+	user.Version++
+}
+
+func (s *Store) UpdateUser(ctx context.Context, user *database.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.users[user.ID]
+	if !ok || stored.Version != user.Version {
+		return database.ErrEditConflict
+	}
+
+	if other := s.userByEmail(user.Email); other != nil && other.ID != user.ID {
+		return database.ErrDuplicateEmail
+	}
+
+	if stored.PasswordHash != user.PasswordHash {
+		now := time.Now()
+		stored.PasswordChangedAt = &now
+	}
+
+	stored.Email = user.Email
+	stored.PasswordHash = user.PasswordHash
+	stored.Activated = user.Activated
+	touch(stored)
+
+	user.UpdatedAt = stored.UpdatedAt
+	user.Version = stored.Version
+	return nil
+}
+
+func (s *Store) UpdateUserHashedPassword(ctx context.Context, id int, hashedPassword string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[id]; ok {
+		now := time.Now()
+		user.PasswordHash = hashedPassword
+		user.PasswordChangedAt = &now
+		touch(user)
+	}
+
+	return nil
+}
+
+func (s *Store) UpdateUserRoleAndPlan(ctx context.Context, user *database.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.users[user.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	stored.Role = user.Role
+	stored.Plan = user.Plan
+	touch(stored)
+
+	user.UpdatedAt = stored.UpdatedAt
+	user.Version = stored.Version
+	return nil
+}
+
+func (s *Store) ActivateUser(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[id]; ok && !user.Activated {
+		user.Activated = true
+		touch(user)
+	}
+
+	return nil
+}
+
+// DeleteUser deletes the user with everything that cascades in Postgres:
+// their tasks, credentials, memberships and the organisations only they are a
+// member of. It returns the IDs of their uploads.
+func (s *Store) DeleteUser(ctx context.Context, id int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for taskID, task := range s.tasks {
+		if task.UserId == id {
+			s.deleteTask(taskID)
+		}
+	}
+
+	for organisationID, members := range s.memberships {
+		if _, ok := members[id]; ok && len(members) == 1 {
+			s.deleteOrganisation(organisationID)
+			continue
+		}
+		delete(members, id)
+	}
+
+	uploadIDs := []string{}
+
+	for uploadID, upload := range s.uploads {
+		if upload.UserID == id {
+			uploadIDs = append(uploadIDs, uploadID)
+			delete(s.uploads, uploadID)
+		}
+	}
+
+	s.deleteCredentials(id)
+	delete(s.users, id)
+
+	return uploadIDs, nil
+}
+
+// deleteCredentials deletes the user's API keys, tokens, identities and
+// logins in progress.
+func (s *Store) deleteCredentials(userId int) {
+	for id, key := range s.apiKeys {
+		if key.UserID == userId {
+			delete(s.apiKeys, id)
+		}
+	}
+
+	for id, token := range s.refreshTokens {
+		if token.UserID == userId {
+			delete(s.refreshTokens, id)
+		}
+	}
+
+	s.deleteUserTokens(func(token *userToken) bool { return token.userId == userId })
+
+	for id, identity := range s.identities {
+		if identity.UserID == userId {
+			delete(s.identities, id)
+		}
+	}
+
+	for state, login := range s.oidcLogins {
+		if login.UserID != nil && *login.UserID == userId {
+			delete(s.oidcLogins, state)
+		}
+	}
+}
+
+func (s *Store) ClaimOutboxMessages(ctx context.Context, limit int, lease time.Duration) ([]*database.OutboxMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	messages := []*database.OutboxMessage{}
+
+	for _, message := range s.outbox {
+		if len(messages) == limit {
+			break
+		}
+
+		if message.SentAt != nil || message.AvailableAt.After(now) {
+			continue
+		}
+
+		message.AvailableAt = now.Add(lease)
+		message.Attempts++
+
+		copied := *message
+		messages = append(messages, &copied)
+	}
+
+	return messages, nil
+}
+
+func (s *Store) MarkOutboxMessagesSent(ctx context.Context, ids []int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	for _, message := range s.outbox {
+		for _, id := range ids {
+			if message.ID == id {
+				message.SentAt = &now
+				message.LastError = ""
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) MarkOutboxMessageFailed(ctx context.Context, id int64, reason string, retryAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, message := range s.outbox {
+		if message.ID == id {
+			message.LastError = reason
+			message.AvailableAt = retryAt
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) DeleteSentOutboxMessages(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int64
+	kept := s.outbox[:0]
+
+	for _, message := range s.outbox {
+		if message.SentAt != nil && message.SentAt.Before(before) {
+			deleted++
+			continue
+		}
+		kept = append(kept, message)
+	}
+
+	s.outbox = kept
+	return deleted, nil
+}
@@ -0,0 +1,179 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Babatunde50/distributask/internal/database"
+)
+
+func (s *Store) InsertOrganisation(ctx context.Context, organisation *database.Organisation, ownerId int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	s.lastOrganisationID++
+	organisation.ID = s.lastOrganisationID
+	organisation.Plan = "free"
+	organisation.CreatedAt = now
+
+	copied := *organisation
+	s.organisations[organisation.ID] = &copied
+
+	s.memberships[organisation.ID] = map[int]*database.Membership{
+		ownerId: {OrganisationID: organisation.ID, UserID: ownerId, Role: database.MembershipRoleOwner, CreatedAt: now},
+	}
+
+	return nil
+}
+
+// deleteOrganisation deletes the organisation with its memberships and
+// tasks, which cascade in Postgres.
+func (s *Store) deleteOrganisation(id int) {
+	for taskID, task := range s.tasks {
+		if task.OrganisationID != nil && *task.OrganisationID == id {
+			s.deleteTask(taskID)
+		}
+	}
+
+	delete(s.memberships, id)
+	delete(s.organisations, id)
+}
+
+func (s *Store) GetOrganisation(ctx context.Context, id int) (*database.Organisation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	organisation, ok := s.organisations[id]
+	if !ok {
+		return nil, nil
+	}
+
+	copied := *organisation
+	return &copied, nil
+}
+
+func (s *Store) ListOrganisations(ctx context.Context, userId int) ([]*database.Organisation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	organisations := []*database.Organisation{}
+
+	for id, members := range s.memberships {
+		if _, ok := members[userId]; ok {
+			copied := *s.organisations[id]
+			organisations = append(organisations, &copied)
+		}
+	}
+
+	sort.Slice(organisations, func(i, j int) bool { return organisations[i].ID < organisations[j].ID })
+
+	return organisations, nil
+}
+
+func (s *Store) GetMembership(ctx context.Context, organisationId, userId int) (*database.Membership, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	membership, ok := s.memberships[organisationId][userId]
+	if !ok {
+		return nil, nil
+	}
+
+	copied := *membership
+	return &copied, nil
+}
+
+func (s *Store) ListMemberships(ctx context.Context, organisationId int) ([]*database.Membership, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	memberships := []*database.Membership{}
+
+	for _, membership := range s.memberships[organisationId] {
+		copied := *membership
+		memberships = append(memberships, &copied)
+	}
+
+	sort.Slice(memberships, func(i, j int) bool {
+		if !memberships[i].CreatedAt.Equal(memberships[j].CreatedAt) {
+			return memberships[i].CreatedAt.Before(memberships[j].CreatedAt)
+		}
+		return memberships[i].UserID < memberships[j].UserID
+	})
+
+	return memberships, nil
+}
+
+func (s *Store) UpsertMembership(ctx context.Context, membership *database.Membership) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	members, ok := s.memberships[membership.OrganisationID]
+	if !ok {
+		return fmt.Errorf("organisation %d does not exist", membership.OrganisationID)
+	}
+
+	if stored, ok := members[membership.UserID]; ok {
+		stored.Role = membership.Role
+		membership.CreatedAt = stored.CreatedAt
+		return nil
+	}
+
+	membership.CreatedAt = time.Now()
+
+	copied := *membership
+	members[membership.UserID] = &copied
+	return nil
+}
+
+func (s *Store) DeleteMembership(ctx context.Context, organisationId, userId int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.memberships[organisationId][userId]; !ok {
+		return false, nil
+	}
+
+	delete(s.memberships[organisationId], userId)
+	return true, nil
+}
+
+// countOwners counts the owners of the organisation other than userId.
+func (s *Store) countOwners(organisationId, userId int) int {
+	var owners int
+
+	for _, membership := range s.memberships[organisationId] {
+		if membership.UserID != userId && membership.Role == database.MembershipRoleOwner {
+			owners++
+		}
+	}
+
+	return owners
+}
+
+func (s *Store) CountOwners(ctx context.Context, organisationId int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.countOwners(organisationId, 0), nil
+}
+
+func (s *Store) CountSoleOwnerships(ctx context.Context, userId int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var count int
+
+	for organisationId, members := range s.memberships {
+		membership, ok := members[userId]
+		if ok && membership.Role == database.MembershipRoleOwner && len(members) > 1 && s.countOwners(organisationId, userId) == 0 {
+			count++
+		}
+	}
+
+	return count, nil
+}
@@ -0,0 +1,126 @@
+package memory
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/Babatunde50/distributask/internal/database"
+)
+
+// dailyCount is the key of the tasks an owner created on a day, which are
+// counted as they are created so deleting tasks doesn't reset the count.
+type dailyCount struct {
+	owner string
+	day   string
+}
+
+func usageOwner(task *database.Task) string {
+	if task.OrganisationID != nil {
+		return "organisation:" + strconv.Itoa(*task.OrganisationID)
+	}
+
+	return "user:" + strconv.Itoa(task.UserId)
+}
+
+func today() string {
+	return time.Now().UTC().Format("2006-01-02")
+}
+
+// checkTaskQuota returns a QuotaError if task would exceed quota, like
+// InsertTask of database.DB does.
+func (s *Store) checkTaskQuota(task *database.Task, quota database.TaskQuota) error {
+	owner := usageOwner(task)
+
+	if quota.MaxDailyTasks > 0 && s.dailyTasks[dailyCount{owner: owner, day: today()}] >= quota.MaxDailyTasks {
+		return &database.QuotaError{Quota: database.QuotaDailyTasks, Limit: quota.MaxDailyTasks}
+	}
+
+	if quota.MaxActiveTasks == 0 {
+		return nil
+	}
+
+	var active int
+
+	for _, other := range s.tasks {
+		if usageOwner(other) != owner {
+			continue
+		}
+
+		if other.Status == database.TaskStatusQueued || other.Status == database.TaskStatusInProgress {
+			active++
+		}
+	}
+
+	if active >= quota.MaxActiveTasks {
+		return &database.QuotaError{Quota: database.QuotaActiveTasks, Limit: quota.MaxActiveTasks}
+	}
+
+	return nil
+}
+
+func (s *Store) GetUsage(ctx context.Context, userId int) (*database.Usage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.usage("user:"+strconv.Itoa(userId), func(task *database.Task) bool {
+		return task.UserId == userId && task.OrganisationID == nil
+	}), nil
+}
+
+func (s *Store) GetOrganisationUsage(ctx context.Context, organisationId int) (*database.Usage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.usage("organisation:"+strconv.Itoa(organisationId), func(task *database.Task) bool {
+		return task.OrganisationID != nil && *task.OrganisationID == organisationId
+	}), nil
+}
+
+// usage counts the tasks owned matches, and those owner created today.
+func (s *Store) usage(owner string, owned func(task *database.Task) bool) *database.Usage {
+	usage := &database.Usage{TasksToday: s.dailyTasks[dailyCount{owner: owner, day: today()}]}
+
+	for _, task := range s.tasks {
+		if !owned(task) {
+			continue
+		}
+
+		switch task.Status {
+		case database.TaskStatusQueued, database.TaskStatusInProgress:
+			usage.ActiveTasks++
+		case database.TaskStatusCompleted:
+			usage.StorageBytes += int64(len(task.Result))
+		}
+
+		for _, result := range s.results[task.ID] {
+			usage.StorageBytes += int64(result.Size)
+		}
+	}
+
+	return usage
+}
+
+func (s *Store) InsertUpload(ctx context.Context, upload *database.Upload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload.CreatedAt = time.Now()
+
+	copied := *upload
+	s.uploads[upload.ID] = &copied
+	return nil
+}
+
+func (s *Store) GetUpload(ctx context.Context, id string, userId int) (*database.Upload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload, ok := s.uploads[id]
+	if !ok || upload.UserID != userId {
+		return nil, nil
+	}
+
+	copied := *upload
+	return &copied, nil
+}
@@ -0,0 +1,183 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const (
+	MembershipRoleOwner  = "owner"
+	MembershipRoleAdmin  = "admin"
+	MembershipRoleMember = "member"
+)
+
+var MembershipRoles = []string{MembershipRoleOwner, MembershipRoleAdmin, MembershipRoleMember}
+
+// Organisation is a team whose members share tasks, results and the quotas of
+// the organisation's plan.
+type Organisation struct {
+	ID        int       `db:"id" json:"id"`
+	Name      string    `db:"name" json:"name"`
+	Plan      string    `db:"plan" json:"plan"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+type Membership struct {
+	OrganisationID int       `db:"organisation_id" json:"organisation_id"`
+	UserID         int       `db:"user_id" json:"user_id"`
+	Role           string    `db:"role" json:"role"`
+	CreatedAt      time.Time `db:"created_at" json:"created_at"`
+}
+
+// CanManage reports whether the member may change the organisation's
+// memberships and delete tasks created by other members.
+func (m *Membership) CanManage() bool {
+	return m.Role == MembershipRoleOwner || m.Role == MembershipRoleAdmin
+}
+
+// InsertOrganisation creates the organisation with ownerId as its owner.
+func (db *DB) InsertOrganisation(ctx context.Context, organisation *Organisation, ownerId int) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO organisations (name)
+		VALUES ($1)
+		RETURNING id, plan, created_at`
+
+	err = tx.QueryRowContext(ctx, query, organisation.Name).Scan(&organisation.ID, &organisation.Plan, &organisation.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO memberships (organisation_id, user_id, role) VALUES ($1, $2, $3)`, organisation.ID, ownerId, MembershipRoleOwner)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *DB) GetOrganisation(ctx context.Context, id int) (*Organisation, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var organisation Organisation
+
+	err := db.GetContext(ctx, &organisation, `SELECT * FROM organisations WHERE id = $1`, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return &organisation, err
+}
+
+// ListOrganisations lists the organisations the user is a member of.
+func (db *DB) ListOrganisations(ctx context.Context, userId int) ([]*Organisation, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	organisations := []*Organisation{}
+
+	query := `
+		SELECT organisations.*
+		FROM organisations
+		JOIN memberships ON memberships.organisation_id = organisations.id
+		WHERE memberships.user_id = $1
+		ORDER BY organisations.id`
+
+	err := db.SelectContext(ctx, &organisations, query, userId)
+	return organisations, err
+}
+
+func (db *DB) GetMembership(ctx context.Context, organisationId, userId int) (*Membership, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var membership Membership
+
+	err := db.GetContext(ctx, &membership, `SELECT * FROM memberships WHERE organisation_id = $1 AND user_id = $2`, organisationId, userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return &membership, err
+}
+
+func (db *DB) ListMemberships(ctx context.Context, organisationId int) ([]*Membership, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	memberships := []*Membership{}
+
+	err := db.SelectContext(ctx, &memberships, `SELECT * FROM memberships WHERE organisation_id = $1 ORDER BY created_at, user_id`, organisationId)
+	return memberships, err
+}
+
+// UpsertMembership adds the user to the organisation, or changes their role
+// if they already are a member.
+func (db *DB) UpsertMembership(ctx context.Context, membership *Membership) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		INSERT INTO memberships (organisation_id, user_id, role)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (organisation_id, user_id) DO UPDATE SET role = EXCLUDED.role
+		RETURNING created_at`
+
+	return db.QueryRowContext(ctx, query, membership.OrganisationID, membership.UserID, membership.Role).Scan(&membership.CreatedAt)
+}
+
+// DeleteMembership reports whether the user was a member of the organisation.
+func (db *DB) DeleteMembership(ctx context.Context, organisationId, userId int) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `DELETE FROM memberships WHERE organisation_id = $1 AND user_id = $2`, organisationId, userId)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// CountOwners returns how many owners the organisation has, so the last one
+// can't leave it without an owner.
+func (db *DB) CountOwners(ctx context.Context, organisationId int) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var owners int
+
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM memberships WHERE organisation_id = $1 AND role = $2`, organisationId, MembershipRoleOwner).Scan(&owners)
+	return owners, err
+}
+
+// CountSoleOwnerships returns how many organisations with other members have
+// the user as their only owner, which they would be left without.
+func (db *DB) CountSoleOwnerships(ctx context.Context, userId int) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		SELECT COUNT(*)
+		FROM memberships AS m
+		WHERE m.user_id = $1 AND m.role = 'owner'
+		AND EXISTS (SELECT 1 FROM memberships WHERE organisation_id = m.organisation_id AND user_id <> $1)
+		AND NOT EXISTS (SELECT 1 FROM memberships WHERE organisation_id = m.organisation_id AND user_id <> $1 AND role = 'owner')`
+
+	var count int
+
+	err := db.QueryRowContext(ctx, query, userId).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// OutboxMessage is a task queue message written in the same transaction as
+// the records it refers to, so it is published if, and only if, they are
+// committed. A relay publishes unsent messages at least once.
+type OutboxMessage struct {
+	ID int64 `db:"id"`
+	// Key identifies what the message is about to the queue, such as a
+	// task. Empty for messages that are only identified by their ID.
+	Key     string `db:"key"`
+	Type    string `db:"type"`
+	Payload []byte `db:"payload"`
+	Queue   string `db:"queue"`
+	// Group is what the message counts against when the queue caps how
+	// many messages run at once, such as the user owning a task. Empty for
+	// messages without a cap.
+	Group    string `db:"group_key"`
+	MaxRetry int    `db:"max_retry"`
+	// Timeout is in seconds, zero for the queue's default.
+	Timeout     int        `db:"timeout"`
+	Attempts    int        `db:"attempts"`
+	LastError   string     `db:"last_error"`
+	AvailableAt time.Time  `db:"available_at"`
+	CreatedAt   time.Time  `db:"created_at"`
+	SentAt      *time.Time `db:"sent_at"`
+}
+
+// TaskMessageKey is the key of the messages that have a task processed, by
+// which the queue can be asked what became of it.
+func TaskMessageKey(taskId int) string {
+	return "task:" + strconv.Itoa(taskId)
+}
+
+// QueueID identifies the message to the queue, which rejects a message it
+// already holds, so it is only enqueued once however often it is relayed.
+func (m *OutboxMessage) QueueID() string {
+	if m.Key != "" {
+		return m.Key
+	}
+
+	return "outbox:" + strconv.FormatInt(m.ID, 10)
+}
+
+// insertOutboxMessage writes message in tx, to be published once tx commits.
+func insertOutboxMessage(ctx context.Context, tx *sql.Tx, message *OutboxMessage) error {
+	query := `
+		INSERT INTO outbox (key, type, payload, queue, group_key, max_retry, timeout)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, available_at, created_at`
+
+	return tx.QueryRowContext(ctx, query, message.Key, message.Type, message.Payload, message.Queue, message.Group, message.MaxRetry, message.Timeout).Scan(&message.ID, &message.AvailableAt, &message.CreatedAt)
+}
+
+// ClaimOutboxMessages returns up to limit unsent messages, oldest first, and
+// hides them from other relays for lease. Messages that are neither marked
+// sent nor failed within the lease are claimed again.
+func (db *DB) ClaimOutboxMessages(ctx context.Context, limit int, lease time.Duration) ([]*OutboxMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		UPDATE outbox
+		SET available_at = NOW() + $2 * INTERVAL '1 second', attempts = attempts + 1
+		WHERE id IN (
+			SELECT id FROM outbox
+			WHERE sent_at IS NULL AND available_at <= NOW()
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING *`
+
+	messages := []*OutboxMessage{}
+
+	err := db.SelectContext(ctx, &messages, query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	// UPDATE ... RETURNING doesn't keep the order of the subquery
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+
+	return messages, nil
+}
+
+func (db *DB) MarkOutboxMessagesSent(ctx context.Context, ids []int64) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `UPDATE outbox SET sent_at = NOW(), last_error = '' WHERE id = ANY($1)`, pq.Array(ids))
+	return err
+}
+
+// MarkOutboxMessageFailed records why the message couldn't be published and
+// when to try again.
+func (db *DB) MarkOutboxMessageFailed(ctx context.Context, id int64, reason string, retryAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `UPDATE outbox SET last_error = $1, available_at = $2 WHERE id = $3`, reason, retryAt, id)
+	return err
+}
+
+// DeleteSentOutboxMessages removes messages sent before the given time.
+func (db *DB) DeleteSentOutboxMessages(ctx context.Context, before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `DELETE FROM outbox WHERE sent_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
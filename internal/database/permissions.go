@@ -0,0 +1,32 @@
+package database
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+const (
+	PermissionTasksRead    = "tasks:read"
+	PermissionTasksWrite   = "tasks:write"
+	PermissionUploadsWrite = "uploads:write"
+	// PermissionOrganisationsRead and PermissionOrganisationsWrite cover
+	// organisations and their members, apart from the tasks they share.
+	PermissionOrganisationsRead  = "organisations:read"
+	PermissionOrganisationsWrite = "organisations:write"
+	PermissionTasksAdmin         = "tasks:admin"
+	PermissionUsersAdmin         = "users:admin"
+	PermissionAuditRead          = "audit:read"
+)
+
+var Roles = []string{RoleUser, RoleAdmin}
+
+var rolePermissions = map[string][]string{
+	RoleUser:  {PermissionTasksRead, PermissionTasksWrite, PermissionUploadsWrite, PermissionOrganisationsRead, PermissionOrganisationsWrite},
+	RoleAdmin: {PermissionTasksRead, PermissionTasksWrite, PermissionUploadsWrite, PermissionOrganisationsRead, PermissionOrganisationsWrite, PermissionTasksAdmin, PermissionUsersAdmin, PermissionAuditRead},
+}
+
+// PermissionsForRole returns everything a user with the given role may do.
+// Tokens and API keys can only ever narrow this down.
+func PermissionsForRole(role string) []string {
+	return rolePermissions[role]
+}
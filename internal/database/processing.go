@@ -4,17 +4,34 @@ import (
 	"database/sql/driver"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"regexp"
 )
 
 type OperationType string
 
 const (
-	Resize OperationType = "resize"
-	Crop   OperationType = "crop"
-	Rotate OperationType = "rotate"
-	Flip   OperationType = "flip"
+	Resize     OperationType = "resize"
+	Crop       OperationType = "crop"
+	Rotate     OperationType = "rotate"
+	Flip       OperationType = "flip"
+	Thumbnails OperationType = "thumbnails"
+	Inspect    OperationType = "inspect"
 )
 
+type FitMode string
+
+const (
+	FitCover     FitMode = "cover"
+	FitContain   FitMode = "contain"
+	FitFill      FitMode = "fill"
+	FitSmartCrop FitMode = "smart-crop"
+)
+
+const maxThumbnailSizes = 10
+
+var rgxThumbnailName = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
 // ResizeParams holds the parameters for the Resize operation
 type ResizeParams struct {
 	Width  int `json:"width"`
@@ -40,17 +57,41 @@ type FlipParams struct {
 	Axis string `json:"axis"`
 }
 
+// ThumbnailSize describes a single variant produced by the Thumbnails operation
+type ThumbnailSize struct {
+	Name   string  `json:"name,omitempty"`
+	Width  int     `json:"width"`
+	Height int     `json:"height"`
+	Fit    FitMode `json:"fit,omitempty"`
+}
+
+// ThumbnailsParams holds the parameters for the Thumbnails operation
+type ThumbnailsParams struct {
+	Sizes []ThumbnailSize `json:"sizes"`
+}
+
 type TransformParams struct {
-	ResizeParams ResizeParams
-	CropParams   CropParams
-	RotateParams RotateParams
-	FlipParams   FlipParams
+	ResizeParams     ResizeParams
+	CropParams       CropParams
+	RotateParams     RotateParams
+	FlipParams       FlipParams
+	ThumbnailsParams ThumbnailsParams
 }
 
 type Payload struct {
-	URL       string          `json:"url"`
-	Operation OperationType   `json:"operation"`
-	Params    TransformParams `json:"params,omitempty"`
+	URL           string          `json:"url,omitempty"`
+	UploadID      string          `json:"upload_id,omitempty"`
+	Operation     OperationType   `json:"operation"`
+	Params        TransformParams `json:"params,omitempty"`
+	StripMetadata bool            `json:"strip_metadata,omitempty"`
+	// AutoOrient is nil unless the client asked for it, see AutoOrients.
+	AutoOrient *bool `json:"auto_orient,omitempty"`
+}
+
+// AutoOrients reports whether the image is rotated according to its EXIF
+// orientation, which it is unless the client turned it off.
+func (p Payload) AutoOrients() bool {
+	return p.AutoOrient == nil || *p.AutoOrient
 }
 
 func (p Payload) Value() (driver.Value, error) {
@@ -58,12 +99,13 @@ func (p Payload) Value() (driver.Value, error) {
 }
 
 type AllPossibleParams struct {
-	Width  int    `json:"width,omitempty"`
-	Axis   string `json:"axis,omitempty"`
-	Angle  int    `json:"angle,omitempty"`
-	X      int    `json:"x,omitempty"`
-	Y      int    `json:"y,omitempty"`
-	Height int    `json:"height,omitempty"`
+	Width  int             `json:"width,omitempty"`
+	Axis   string          `json:"axis,omitempty"`
+	Angle  int             `json:"angle,omitempty"`
+	X      int             `json:"x,omitempty"`
+	Y      int             `json:"y,omitempty"`
+	Height int             `json:"height,omitempty"`
+	Sizes  []ThumbnailSize `json:"sizes,omitempty"`
 }
 
 func (p *Payload) UpdateParams(op OperationType, params AllPossibleParams) error {
@@ -97,12 +139,64 @@ func (p *Payload) UpdateParams(op OperationType, params AllPossibleParams) error
 		p.Params.FlipParams = FlipParams{
 			Axis: params.Axis,
 		}
+	case Thumbnails:
+		sizes, err := normalizeThumbnailSizes(params.Sizes)
+		if err != nil {
+			return err
+		}
+		p.Params.ThumbnailsParams = ThumbnailsParams{
+			Sizes: sizes,
+		}
 	}
 
 	return nil
 
 }
 
+func normalizeThumbnailSizes(sizes []ThumbnailSize) ([]ThumbnailSize, error) {
+	if len(sizes) == 0 {
+		return nil, errors.New("provide at least one size to generate thumbnails for")
+	}
+
+	if len(sizes) > maxThumbnailSizes {
+		return nil, fmt.Errorf("provide at most %d thumbnail sizes", maxThumbnailSizes)
+	}
+
+	normalized := make([]ThumbnailSize, len(sizes))
+	names := make(map[string]bool, len(sizes))
+
+	for i, size := range sizes {
+		if size.Width <= 0 || size.Height <= 0 {
+			return nil, errors.New("provide a width and height for every thumbnail size")
+		}
+
+		switch size.Fit {
+		case "":
+			size.Fit = FitCover
+		case FitCover, FitContain, FitFill, FitSmartCrop:
+		default:
+			return nil, fmt.Errorf("unsupported fit mode %q", size.Fit)
+		}
+
+		if size.Name == "" {
+			size.Name = fmt.Sprintf("%dx%d-%s", size.Width, size.Height, size.Fit)
+		}
+
+		if !rgxThumbnailName.MatchString(size.Name) {
+			return nil, fmt.Errorf("thumbnail name %q may only contain letters, digits, dashes and underscores", size.Name)
+		}
+
+		if names[size.Name] {
+			return nil, fmt.Errorf("duplicate thumbnail name %q", size.Name)
+		}
+		names[size.Name] = true
+
+		normalized[i] = size
+	}
+
+	return normalized, nil
+}
+
 func (p *Payload) Scan(value interface{}) error {
 	b, ok := value.([]byte)
 	if !ok {
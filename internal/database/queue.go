@@ -0,0 +1,333 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// QueueChannel is notified with the queue of every job enqueued, once the
+// transaction enqueueing it commits.
+const QueueChannel = "queue_jobs"
+
+const (
+	// JobStatePending jobs wait for a worker, from run_at on.
+	JobStatePending = "pending"
+	// JobStateActive jobs are leased by a worker until leased_until.
+	JobStateActive = "active"
+	// JobStateArchived jobs failed for good and are kept for inspection.
+	JobStateArchived = "archived"
+)
+
+// QueueJob is a message in the Postgres queue, the alternative to Redis for
+// deployments that would rather not run it. Jobs are deleted once
+// processed.
+type QueueJob struct {
+	ID int64 `db:"id"`
+	// Key identifies the job like an asynq task ID, a second job with the
+	// same key isn't enqueued while the first one exists.
+	Key     string `db:"key"`
+	Type    string `db:"type"`
+	Payload []byte `db:"payload"`
+	Queue   string `db:"queue"`
+	// Group is what the job counts against when workers cap how many jobs
+	// of the same group are active at once.
+	Group    string `db:"group_key"`
+	MaxRetry int    `db:"max_retry"`
+	// Timeout is in seconds, zero for the worker's default.
+	Timeout     int        `db:"timeout"`
+	Retried     int        `db:"retried"`
+	State       string     `db:"state"`
+	LastError   string     `db:"last_error"`
+	RunAt       time.Time  `db:"run_at"`
+	LeasedBy    string     `db:"leased_by"`
+	LeasedUntil *time.Time `db:"leased_until"`
+	ArchivedAt  *time.Time `db:"archived_at"`
+	CreatedAt   time.Time  `db:"created_at"`
+}
+
+// UseQueue has InsertTask and RequeueTask write their messages straight into
+// the Postgres queue, in the same transaction as the task, instead of the
+// outbox. It is meant to be called on startup when the Postgres queue is the
+// task queue.
+func (db *DB) UseQueue() {
+	db.queueJobs = true
+}
+
+// publish writes message in tx, to be published once tx commits.
+func (db *DB) publish(ctx context.Context, tx *sql.Tx, message *OutboxMessage) error {
+	if !db.queueJobs {
+		return insertOutboxMessage(ctx, tx, message)
+	}
+
+	_, err := insertQueueJob(ctx, tx, &QueueJob{
+		Key:      message.Key,
+		Type:     message.Type,
+		Payload:  message.Payload,
+		Queue:    message.Queue,
+		Group:    message.Group,
+		MaxRetry: message.MaxRetry,
+		Timeout:  message.Timeout,
+	})
+
+	return err
+}
+
+// queryRower is implemented by both *sqlx.DB and *sql.Tx.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// insertQueueJob enqueues job unless a job with the same key exists, in
+// which case it reports false.
+func insertQueueJob(ctx context.Context, q queryRower, job *QueueJob) (bool, error) {
+	// the database's clock decides when a job without a time is due, like
+	// for every other lease and timeout of the queue
+	var runAt any
+	if !job.RunAt.IsZero() {
+		runAt = job.RunAt
+	}
+
+	query := `
+		INSERT INTO queue_jobs (key, type, payload, queue, group_key, max_retry, timeout, run_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, COALESCE($8::timestamptz, NOW()))
+		ON CONFLICT (key) WHERE key <> '' DO NOTHING
+		RETURNING id, state, run_at, created_at`
+
+	err := q.QueryRowContext(ctx, query, job.Key, job.Type, job.Payload, job.Queue, job.Group, job.MaxRetry, job.Timeout, runAt).Scan(&job.ID, &job.State, &job.RunAt, &job.CreatedAt)
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	return true, nil
+}
+
+// EnqueueJob enqueues job unless a job with the same key exists, in which
+// case it reports false.
+func (db *DB) EnqueueJob(ctx context.Context, job *QueueJob) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	return insertQueueJob(ctx, db, job)
+}
+
+// ClaimJob leases the next due job of the given queues to worker for lease,
+// taking the queues in the order given. Jobs whose group already has
+// maxPerGroup active jobs are passed over, unless maxPerGroup is zero. It
+// returns nil if there is no job to claim.
+func (db *DB) ClaimJob(ctx context.Context, queues []string, worker string, lease time.Duration, maxPerGroup int) (*QueueJob, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	// groups found at their cap, which the next candidate mustn't be from
+	full := []string{}
+
+	for {
+		job, fullGroup, err := db.claimJob(ctx, queues, worker, lease, maxPerGroup, full)
+		if err != nil || fullGroup == "" {
+			return job, err
+		}
+
+		full = append(full, fullGroup)
+	}
+}
+
+// claimJob claims the next due job not of a group in full. If the job's
+// group turns out to be at its cap once the group's lock is held, it claims
+// nothing and returns the group instead.
+func (db *DB) claimJob(ctx context.Context, queues []string, worker string, lease time.Duration, maxPerGroup int, full []string) (*QueueJob, string, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT id, group_key FROM queue_jobs AS j
+		WHERE state = 'pending' AND run_at <= NOW() AND queue = ANY($1::text[])
+		AND group_key <> ALL($3::text[])
+		AND ($2 = 0 OR group_key = '' OR (
+			SELECT count(*) FROM queue_jobs
+			WHERE state = 'active' AND group_key = j.group_key) < $2)
+		ORDER BY array_position($1::text[], queue), run_at, id
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED`
+
+	var candidate struct {
+		ID    int64  `db:"id"`
+		Group string `db:"group_key"`
+	}
+
+	err = tx.GetContext(ctx, &candidate, query, pq.Array(queues), maxPerGroup, pq.Array(full))
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, "", nil
+	case err != nil:
+		return nil, "", err
+	}
+
+	// workers claiming jobs of the same group at the same moment would each
+	// see it below its cap, so they take turns per group and count again
+	if maxPerGroup > 0 && candidate.Group != "" {
+		_, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext('queue_jobs:' || $1))`, candidate.Group)
+		if err != nil {
+			return nil, "", err
+		}
+
+		var active int
+
+		err = tx.GetContext(ctx, &active, `SELECT count(*) FROM queue_jobs WHERE state = 'active' AND group_key = $1`, candidate.Group)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if active >= maxPerGroup {
+			return nil, candidate.Group, nil
+		}
+	}
+
+	query = `
+		UPDATE queue_jobs
+		SET state = 'active', leased_by = $2, leased_until = NOW() + $3 * INTERVAL '1 second'
+		WHERE id = $1
+		RETURNING *`
+
+	var job QueueJob
+
+	err = tx.GetContext(ctx, &job, query, candidate.ID, worker, lease.Seconds())
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &job, "", tx.Commit()
+}
+
+// ExtendJobLeases extends the leases worker holds on the given jobs, so
+// they aren't claimed again while it is still processing them.
+func (db *DB) ExtendJobLeases(ctx context.Context, worker string, ids []int64, lease time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		UPDATE queue_jobs
+		SET leased_until = NOW() + $3 * INTERVAL '1 second'
+		WHERE id = ANY($1) AND leased_by = $2 AND state = 'active'`
+
+	_, err := db.ExecContext(ctx, query, pq.Array(ids), worker, lease.Seconds())
+	return err
+}
+
+// CompleteJob deletes a job worker processed. It does nothing if worker lost
+// its lease in the meantime.
+func (db *DB) CompleteJob(ctx context.Context, id int64, worker string) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `DELETE FROM queue_jobs WHERE id = $1 AND leased_by = $2 AND state = 'active'`, id, worker)
+	return err
+}
+
+// RetryJob puts a job worker failed to process back into the queue, to be
+// claimed again once delay has passed.
+func (db *DB) RetryJob(ctx context.Context, id int64, worker, reason string, delay time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		UPDATE queue_jobs
+		SET state = 'pending', retried = retried + 1, last_error = $3, run_at = NOW() + $4 * INTERVAL '1 second', leased_by = '', leased_until = NULL
+		WHERE id = $1 AND leased_by = $2 AND state = 'active'`
+
+	_, err := db.ExecContext(ctx, query, id, worker, reason, delay.Seconds())
+	return err
+}
+
+// ArchiveJob gives up on a job worker failed to process.
+func (db *DB) ArchiveJob(ctx context.Context, id int64, worker, reason string) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		UPDATE queue_jobs
+		SET state = 'archived', archived_at = NOW(), last_error = $3, leased_by = '', leased_until = NULL
+		WHERE id = $1 AND leased_by = $2 AND state = 'active'`
+
+	_, err := db.ExecContext(ctx, query, id, worker, reason)
+	return err
+}
+
+// RecoverExpiredJobs puts active jobs whose lease ran out, because their
+// worker crashed or lost its connection, back into the queue, or archives
+// them if they are out of retries.
+func (db *DB) RecoverExpiredJobs(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		UPDATE queue_jobs
+		SET state = CASE WHEN retried < max_retry THEN 'pending' ELSE 'archived' END,
+			archived_at = CASE WHEN retried < max_retry THEN NULL ELSE NOW() END,
+			retried = retried + 1, last_error = 'lease expired', run_at = NOW(), leased_by = '', leased_until = NULL
+		WHERE state = 'active' AND leased_until < NOW()`
+
+	result, err := db.ExecContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// DeleteArchivedJobs removes jobs archived before the given time.
+func (db *DB) DeleteArchivedJobs(ctx context.Context, before time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `DELETE FROM queue_jobs WHERE state = 'archived' AND archived_at < $1`, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// GetJob returns the job of the queue holding key, or nil if there is none.
+func (db *DB) GetJob(ctx context.Context, queue, key string) (*QueueJob, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var job QueueJob
+
+	err := db.GetContext(ctx, &job, `SELECT * FROM queue_jobs WHERE queue = $1 AND key = $2`, queue, key)
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// QueueListener returns a listener on QueueChannel, which has to be closed
+// once done with.
+func (db *DB) QueueListener() (*pq.Listener, error) {
+	listener := pq.NewListener("postgres://"+db.dsn, 10*time.Second, time.Minute, nil)
+
+	err := listener.Listen(QueueChannel)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
@@ -0,0 +1,116 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// StuckTask is a task which looks like it has been forgotten: queued without
+// a message waiting in the outbox, or in progress for longer than its
+// timeout.
+type StuckTask struct {
+	ID         int       `db:"id"`
+	UserId     int       `db:"user_id"`
+	Status     string    `db:"status"`
+	Priority   int       `db:"priority"`
+	Timeout    int       `db:"timeout"`
+	MaxRetries int       `db:"max_retries"`
+	UpdatedAt  time.Time `db:"updated_at"`
+}
+
+// ListStuckTasks returns up to limit tasks that were queued before cutoff, or
+// whose timeout ran out before it.
+func (db *DB) ListStuckTasks(ctx context.Context, cutoff time.Time, limit int) ([]*StuckTask, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		SELECT id, user_id, status, priority, timeout, max_retries, updated_at
+		FROM tasks
+		WHERE (status = 'queued' AND updated_at < $1
+			-- matches TaskMessageKey
+			AND NOT EXISTS (SELECT 1 FROM outbox WHERE key = 'task:' || tasks.id AND sent_at IS NULL))
+		OR (status = 'in_progress' AND updated_at + timeout * INTERVAL '1 second' < $1)
+		ORDER BY updated_at
+		LIMIT $2`
+
+	tasks := []*StuckTask{}
+
+	err := db.SelectContext(ctx, &tasks, query, cutoff, limit)
+	return tasks, err
+}
+
+// RequeueTask queues a task whose message was lost again, through the outbox
+// or straight into the Postgres queue if it is in use. It reports false if
+// the task is no longer queued.
+func (db *DB) RequeueTask(ctx context.Context, id int, message *OutboxMessage, reason string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// touching the task gives the requeued message time to arrive before the
+	// task is considered stuck again
+	result, err := tx.ExecContext(ctx, `UPDATE tasks SET updated_at = NOW(), version = version + 1 WHERE id = $1 AND status = $2`, id, TaskStatusQueued)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil || rows == 0 {
+		return false, err
+	}
+
+	err = insertTaskEvent(ctx, tx, &TaskEvent{TaskID: id, Type: TaskEventQueued, Details: reason})
+	if err != nil {
+		return false, err
+	}
+
+	err = db.publish(ctx, tx, message)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// FailStuckTask gives up on a task the queue lost track of, moving it from
+// the from status to the to status. It reports false if the task's status is
+// no longer from.
+func (db *DB) FailStuckTask(ctx context.Context, id int, from, to, reason string) (bool, error) {
+	if !CanTransition(from, to) {
+		return false, fmt.Errorf("%w: %s to %s", ErrInvalidTransition, from, to)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `UPDATE tasks SET status = $1, updated_at = NOW(), version = version + 1 WHERE id = $2 AND status = $3`, to, id, from)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil || rows == 0 {
+		return false, err
+	}
+
+	// the failed statuses double as event types
+	err = insertTaskEvent(ctx, tx, &TaskEvent{TaskID: id, Type: to, Details: reason})
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
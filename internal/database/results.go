@@ -0,0 +1,93 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// TaskResult is a single output object produced by a task, such as one
+// variant of a thumbnails operation.
+type TaskResult struct {
+	ID          int       `db:"id" json:"-"`
+	TaskID      int       `db:"task_id" json:"-"`
+	Name        string    `db:"name" json:"name"`
+	ContentType string    `db:"content_type" json:"content_type"`
+	Width       int       `db:"width" json:"width"`
+	Height      int       `db:"height" json:"height"`
+	Size        int       `db:"size" json:"size"`
+	Data        []byte    `db:"data" json:"-"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+}
+
+// InsertTaskResults replaces the results stored for a task, so a retried
+// task doesn't fail on the results written by an earlier attempt.
+func (db *DB) InsertTaskResults(ctx context.Context, taskID int, results []*TaskResult) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM task_results WHERE task_id = $1`, taskID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO task_results (task_id, name, content_type, width, height, size, data)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at`
+
+	for _, result := range results {
+		result.TaskID = taskID
+
+		err = tx.QueryRowContext(ctx, query, taskID, result.Name, result.ContentType, result.Width, result.Height, result.Size, result.Data).Scan(&result.ID, &result.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ListTaskResults returns the results of a task without their data.
+func (db *DB) ListTaskResults(ctx context.Context, taskID int) ([]*TaskResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		SELECT id, task_id, name, content_type, width, height, size, created_at
+		FROM task_results
+		WHERE task_id = $1
+		ORDER BY id`
+
+	var results []*TaskResult
+
+	err := db.SelectContext(ctx, &results, query, taskID)
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func (db *DB) GetTaskResult(ctx context.Context, taskID int, name string) (*TaskResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var result TaskResult
+
+	query := `SELECT * FROM task_results WHERE task_id = $1 AND name = $2`
+
+	err := db.GetContext(ctx, &result, query, taskID, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return &result, err
+}
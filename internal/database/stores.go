@@ -0,0 +1,120 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// TaskStore stores tasks together with their history and results. DB stores
+// them in Postgres, memory.Store in memory for tests that don't need a
+// database.
+type TaskStore interface {
+	InsertTask(ctx context.Context, task *Task, quota TaskQuota, newMessage func(createdTask *Task) (*OutboxMessage, error)) error
+	GetTask(ctx context.Context, id, userId int) (*Task, error)
+	GetTaskByID(ctx context.Context, id int) (*Task, error)
+	ListTasks(ctx context.Context, userId, organisationId int, filters Filters) ([]*Task, error)
+	ListAllTasks(ctx context.Context, userId int, filters Filters) ([]*Task, error)
+	UpdateTask(ctx context.Context, task *Task) error
+	UpdateTaskProgress(ctx context.Context, id int, progress TaskProgress) error
+	MarkStarted(ctx context.Context, task *Task, attempt TaskAttempt) error
+	MarkCompleted(ctx context.Context, task *Task, attempt TaskAttempt) error
+	MarkFailed(ctx context.Context, task *Task, attempt TaskAttempt, status, reason string) error
+	DeleteTask(ctx context.Context, id, userId int) (bool, error)
+	DeleteTaskByID(ctx context.Context, id int) (bool, error)
+	ListTaskEvents(ctx context.Context, taskId int) ([]*TaskEvent, error)
+	InsertTaskResults(ctx context.Context, taskID int, results []*TaskResult) error
+	ListTaskResults(ctx context.Context, taskID int) ([]*TaskResult, error)
+	GetTaskResult(ctx context.Context, taskID int, name string) (*TaskResult, error)
+}
+
+// UserStore stores user accounts, the single-use tokens emailed to them and
+// the identities they log in with.
+type UserStore interface {
+	InsertUser(ctx context.Context, email, hashedPassword string) (int, error)
+	GetUser(ctx context.Context, id int) (*User, error)
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+	ListUsers(ctx context.Context, filters Filters) ([]*User, error)
+	UpdateUser(ctx context.Context, user *User) error
+	UpdateUserHashedPassword(ctx context.Context, id int, hashedPassword string) error
+	UpdateUserRoleAndPlan(ctx context.Context, user *User) error
+	ActivateUser(ctx context.Context, id int) error
+	DeleteUser(ctx context.Context, id int) ([]string, error)
+	InsertUserToken(ctx context.Context, hash []byte, userId int, scope string, expiresAt time.Time) error
+	ConsumeUserToken(ctx context.Context, hash []byte, scope string) (*User, error)
+	DeleteUserTokens(ctx context.Context, userId int, scope string) error
+	InsertIdentity(ctx context.Context, identity *Identity) error
+	ListIdentities(ctx context.Context, userId int) ([]*Identity, error)
+	GetUserByIdentity(ctx context.Context, issuer, subject string) (*User, error)
+	InsertOIDCLogin(ctx context.Context, login *OIDCLogin) error
+	ConsumeOIDCLogin(ctx context.Context, stateHash []byte) (*OIDCLogin, error)
+}
+
+// AuthStore stores the credentials clients authenticate with: API keys,
+// refresh tokens and the access tokens revoked before they expire.
+type AuthStore interface {
+	InsertAPIKey(ctx context.Context, key *APIKey) error
+	GetAPIKeyByHash(ctx context.Context, hash []byte) (*APIKey, error)
+	ListAPIKeys(ctx context.Context, userId int) ([]*APIKey, error)
+	DeleteAPIKey(ctx context.Context, id, userId int) (bool, error)
+	TouchAPIKey(ctx context.Context, id int) error
+	InsertRefreshToken(ctx context.Context, token *RefreshToken) error
+	GetRefreshTokenByHash(ctx context.Context, hash []byte) (*RefreshToken, error)
+	RotateRefreshToken(ctx context.Context, old, replacement *RefreshToken) error
+	RevokeRefreshTokenFamily(ctx context.Context, familyID string) error
+	RevokeUserRefreshTokens(ctx context.Context, userId int) error
+	RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error
+	IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error)
+}
+
+// OrganisationStore stores organisations and their memberships.
+type OrganisationStore interface {
+	InsertOrganisation(ctx context.Context, organisation *Organisation, ownerId int) error
+	GetOrganisation(ctx context.Context, id int) (*Organisation, error)
+	ListOrganisations(ctx context.Context, userId int) ([]*Organisation, error)
+	GetMembership(ctx context.Context, organisationId, userId int) (*Membership, error)
+	ListMemberships(ctx context.Context, organisationId int) ([]*Membership, error)
+	UpsertMembership(ctx context.Context, membership *Membership) error
+	DeleteMembership(ctx context.Context, organisationId, userId int) (bool, error)
+	CountOwners(ctx context.Context, organisationId int) (int, error)
+	CountSoleOwnerships(ctx context.Context, userId int) (int, error)
+}
+
+// UsageStore stores uploads and counts what users and organisations use
+// against the quotas of their plan.
+type UsageStore interface {
+	GetUsage(ctx context.Context, userId int) (*Usage, error)
+	GetOrganisationUsage(ctx context.Context, organisationId int) (*Usage, error)
+	InsertUpload(ctx context.Context, upload *Upload) error
+	GetUpload(ctx context.Context, id string, userId int) (*Upload, error)
+}
+
+// AuditStore stores the audit log.
+type AuditStore interface {
+	InsertAuditEvent(ctx context.Context, event *AuditEvent) error
+	ListAuditEvents(ctx context.Context, auditFilters AuditFilters, filters Filters) ([]*AuditEvent, error)
+	ExportAuditEvents(ctx context.Context, auditFilters AuditFilters, fn func(*AuditEvent) error) error
+}
+
+// Store is every store the API uses.
+type Store interface {
+	TaskStore
+	UserStore
+	AuthStore
+	OrganisationStore
+	UsageStore
+	AuditStore
+}
+
+// OutboxStore holds the messages written by InsertTask until the outbox
+// relay publishes them.
+type OutboxStore interface {
+	ClaimOutboxMessages(ctx context.Context, limit int, lease time.Duration) ([]*OutboxMessage, error)
+	MarkOutboxMessagesSent(ctx context.Context, ids []int64) error
+	MarkOutboxMessageFailed(ctx context.Context, id int64, reason string, retryAt time.Time) error
+	DeleteSentOutboxMessages(ctx context.Context, before time.Time) (int64, error)
+}
+
+var (
+	_ Store       = (*DB)(nil)
+	_ OutboxStore = (*DB)(nil)
+)
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+const (
+	TaskEventQueued    = "queued"
+	TaskEventStarted   = "started"
+	TaskEventRetrying  = "retrying"
+	TaskEventCompleted = "completed"
+	TaskEventFailed    = "failed"
+	TaskEventTimedOut  = "timed_out"
+)
+
+// TaskEvent is one transition in the lifecycle of a task. Unlike the task's
+// status, events are never overwritten, so they tell when each transition
+// happened.
+type TaskEvent struct {
+	ID        int64     `db:"id" json:"id"`
+	TaskID    int       `db:"task_id" json:"task_id"`
+	Type      string    `db:"type" json:"type"`
+	Worker    string    `db:"worker" json:"worker,omitempty"`
+	Attempt   int       `db:"attempt" json:"attempt"`
+	Details   string    `db:"details" json:"details,omitempty"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// insertTaskEvent records event in tx, which also changes the task's status.
+func insertTaskEvent(ctx context.Context, tx *sql.Tx, event *TaskEvent) error {
+	query := `
+		INSERT INTO task_events (task_id, type, worker, attempt, details)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+
+	return tx.QueryRowContext(ctx, query, event.TaskID, event.Type, event.Worker, event.Attempt, event.Details).Scan(&event.ID, &event.CreatedAt)
+}
+
+// ListTaskEvents returns the history of a task, oldest first.
+func (db *DB) ListTaskEvents(ctx context.Context, taskId int) ([]*TaskEvent, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	events := []*TaskEvent{}
+
+	err := db.SelectContext(ctx, &events, `SELECT * FROM task_events WHERE task_id = $1 ORDER BY id`, taskId)
+	return events, err
+}
+
+// TaskDurations is how long a task waited in the queue before a worker first
+// picked it up, and how long its last attempt ran. Either is nil until the
+// task got that far.
+type TaskDurations struct {
+	QueueWait *time.Duration
+	Run       *time.Duration
+}
+
+// Durations derives the durations of a task from its history, which must be
+// ordered oldest first.
+func Durations(events []*TaskEvent) TaskDurations {
+	var durations TaskDurations
+	var queued, started *TaskEvent
+
+	for _, event := range events {
+		switch event.Type {
+		case TaskEventQueued:
+			if queued == nil {
+				queued = event
+			}
+		case TaskEventStarted:
+			if queued != nil && durations.QueueWait == nil {
+				wait := event.CreatedAt.Sub(queued.CreatedAt)
+				durations.QueueWait = &wait
+			}
+			started = event
+			durations.Run = nil
+		case TaskEventRetrying, TaskEventCompleted, TaskEventFailed, TaskEventTimedOut:
+			if started != nil && durations.Run == nil {
+				run := event.CreatedAt.Sub(started.CreatedAt)
+				durations.Run = &run
+			}
+		}
+	}
+
+	return durations
+}
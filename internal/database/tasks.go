@@ -2,9 +2,27 @@ package database
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"time"
 )
 
+const (
+	TaskStatusQueued     = "queued"
+	TaskStatusInProgress = "in_progress"
+	TaskStatusCompleted  = "completed"
+	TaskStatusFailed     = "failed"
+	TaskStatusTimedOut   = "timed_out"
+)
+
+// Task priorities, which pick the queue tier a task is processed from.
+const (
+	TaskPriorityLow     = 1
+	TaskPriorityDefault = 2
+	TaskPriorityHigh    = 3
+)
+
 type Filters struct {
 	Page     int
 	PageSize int
@@ -18,45 +36,81 @@ func (f Filters) offset() int {
 	return (f.Page - 1) * f.PageSize
 }
 
+// TaskProgress is the last progress reported by the worker running a task.
+type TaskProgress struct {
+	Percent int    `json:"percent"`
+	Phase   string `json:"phase,omitempty"`
+}
+
 type Task struct {
-	ID         int       `db:"id" json:"id"`
-	Type       string    `db:"type" json:"type"`
-	Payload    Payload   `db:"payload" json:"payload"`
-	Priority   int       `db:"priority" json:"priority"`
-	Status     string    `db:"status" json:"status"`
-	CreatedAt  time.Time `db:"created_at" json:"created_at"`
-	UpdatedAt  time.Time `db:"updated_at" json:"updated_at"`
-	Timeout    int       `db:"timeout" json:"timeout"`
-	RetryCount int       `db:"retry_count" json:"retry_count"`
-	MaxRetries int       `db:"max_retries" json:"max_retries"`
-	Result     string    `db:"result" json:"result,omitempty"`
-	UserId     int       `db:"user_id" json:"-"`
+	ID         int          `db:"id" json:"id"`
+	Type       string       `db:"type" json:"type"`
+	Payload    Payload      `db:"payload" json:"payload"`
+	Priority   int          `db:"priority" json:"priority"`
+	Status     string       `db:"status" json:"status"`
+	CreatedAt  time.Time    `db:"created_at" json:"created_at"`
+	UpdatedAt  time.Time    `db:"updated_at" json:"updated_at"`
+	Timeout    int          `db:"timeout" json:"timeout"`
+	RetryCount int          `db:"retry_count" json:"retry_count"`
+	MaxRetries int          `db:"max_retries" json:"max_retries"`
+	Result     string       `db:"result" json:"result,omitempty"`
+	Progress   TaskProgress `db:"-" json:"progress"`
+	UserId     int          `db:"user_id" json:"-"`
+	// OrganisationID is set for tasks shared with the members of an organisation.
+	OrganisationID *int `db:"organisation_id" json:"organisation_id,omitempty"`
+	// Version is bumped by every update, which only applies to the version
+	// it was read at.
+	Version int `db:"version" json:"-"`
 }
 
-func (db *DB) InsertTask(task *Task, AfterCreate func(createdTask *Task) error) error {
+// InsertTask creates the task together with the queue message built by
+// newMessage, which is published after the transaction commits. It returns a
+// QuotaError if the task would exceed quota.
+func (db *DB) InsertTask(ctx context.Context, task *Task, quota TaskQuota, newMessage func(createdTask *Task) (*OutboxMessage, error)) error {
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
 
-	tx, err := db.Begin()
+	tx, err := db.BeginTx(ctx, nil)
 
 	if err != nil {
 		return err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
-	defer cancel()
+	err = reserveTask(ctx, tx, task, quota)
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 
 	query := `
-		INSERT INTO tasks (type, payload, priority, timeout, max_retries, user_id)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		RETURNING id, created_at, updated_at, status`
+		INSERT INTO tasks (type, payload, priority, timeout, max_retries, user_id, organisation_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at, updated_at, status, version`
 
-	err = tx.QueryRowContext(ctx, query, task.Type, task.Payload, task.Priority, task.Timeout, task.MaxRetries, task.UserId).Scan(&task.ID, &task.CreatedAt, &task.UpdatedAt, &task.Status)
+	err = tx.QueryRowContext(ctx, query, task.Type, task.Payload, task.Priority, task.Timeout, task.MaxRetries, task.UserId, task.OrganisationID).Scan(&task.ID, &task.CreatedAt, &task.UpdatedAt, &task.Status, &task.Version)
 
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
 
-	err = AfterCreate(task)
+	err = insertTaskEvent(ctx, tx, &TaskEvent{TaskID: task.ID, Type: TaskEventQueued})
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	message, err := newMessage(task)
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	err = db.publish(ctx, tx, message)
 
 	if err != nil {
 		tx.Rollback()
@@ -72,20 +126,21 @@ func (db *DB) InsertTask(task *Task, AfterCreate func(createdTask *Task) error)
 	return nil
 }
 
-func (db *DB) GetTask(id, userId int) (*Task, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+func (db *DB) GetTask(ctx context.Context, id, userId int) (*Task, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	query := `
-		SELECT id, type, payload, priority, status, created_at, updated_at, timeout, retry_count, max_retries, result, user_id
+		SELECT id, type, payload, priority, status, created_at, updated_at, timeout, retry_count, max_retries, result, progress, progress_phase, user_id, organisation_id, version
 		FROM tasks
-		WHERE id = $1 AND user_id = $2
+		WHERE id = $1 AND (user_id = $2 OR organisation_id IN (
+			SELECT organisation_id FROM memberships WHERE user_id = $2))
 		`
 
 	var task Task
 
 	err := db.QueryRowContext(ctx, query, id, userId).Scan(
-		&task.ID, &task.Type, &task.Payload, &task.Priority, &task.Status, &task.CreatedAt, &task.UpdatedAt, &task.Timeout, &task.RetryCount, &task.MaxRetries, &task.Result, &task.UserId)
+		&task.ID, &task.Type, &task.Payload, &task.Priority, &task.Status, &task.CreatedAt, &task.UpdatedAt, &task.Timeout, &task.RetryCount, &task.MaxRetries, &task.Result, &task.Progress.Percent, &task.Progress.Phase, &task.UserId, &task.OrganisationID, &task.Version)
 
 	if err != nil {
 		return nil, err
@@ -94,14 +149,81 @@ func (db *DB) GetTask(id, userId int) (*Task, error) {
 	return &task, nil
 }
 
-func (db *DB) ListTasks(userId int, filters Filters) ([]*Task, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+// ListTasks lists the tasks visible to the user, or only those of
+// organisationId if it isn't zero.
+func (db *DB) ListTasks(ctx context.Context, userId, organisationId int, filters Filters) ([]*Task, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	query := `
-		SELECT id, type, payload, priority, status, created_at, updated_at, timeout, retry_count, max_retries, result
+		SELECT id, type, payload, priority, status, created_at, updated_at, timeout, retry_count, max_retries, result, progress, progress_phase, user_id, organisation_id, version
 		FROM tasks
-		WHERE user_id = $1
+		WHERE (user_id = $1 OR organisation_id IN (
+			SELECT organisation_id FROM memberships WHERE user_id = $1))
+		AND ($2 = 0 OR organisation_id = $2)
+		ORDER BY id
+		LIMIT $3 OFFSET $4`
+
+	rows, err := db.QueryContext(ctx, query, userId, organisationId, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []*Task
+
+	for rows.Next() {
+		var task Task
+		err := rows.Scan(&task.ID, &task.Type, &task.Payload, &task.Priority, &task.Status, &task.CreatedAt, &task.UpdatedAt, &task.Timeout, &task.RetryCount, &task.MaxRetries, &task.Result, &task.Progress.Percent, &task.Progress.Phase, &task.UserId, &task.OrganisationID, &task.Version)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tasks = append(tasks, &task)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tasks, nil
+}
+
+// GetTaskByID returns a task regardless of who owns it.
+func (db *DB) GetTaskByID(ctx context.Context, id int) (*Task, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		SELECT id, type, payload, priority, status, created_at, updated_at, timeout, retry_count, max_retries, result, progress, progress_phase, user_id, organisation_id, version
+		FROM tasks
+		WHERE id = $1
+		`
+
+	var task Task
+
+	err := db.QueryRowContext(ctx, query, id).Scan(
+		&task.ID, &task.Type, &task.Payload, &task.Priority, &task.Status, &task.CreatedAt, &task.UpdatedAt, &task.Timeout, &task.RetryCount, &task.MaxRetries, &task.Result, &task.Progress.Percent, &task.Progress.Phase, &task.UserId, &task.OrganisationID, &task.Version)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &task, nil
+}
+
+// ListAllTasks lists the tasks of every user, or only those of userId if it
+// isn't zero.
+func (db *DB) ListAllTasks(ctx context.Context, userId int, filters Filters) ([]*Task, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		SELECT id, type, payload, priority, status, created_at, updated_at, timeout, retry_count, max_retries, result, progress, progress_phase, user_id, organisation_id, version
+		FROM tasks
+		WHERE ($1 = 0 OR user_id = $1)
+		ORDER BY id
 		LIMIT $2 OFFSET $3
 		`
 
@@ -111,11 +233,11 @@ func (db *DB) ListTasks(userId int, filters Filters) ([]*Task, error) {
 	}
 	defer rows.Close()
 
-	var tasks []*Task
+	tasks := []*Task{}
 
 	for rows.Next() {
 		var task Task
-		err := rows.Scan(&task.ID, &task.Type, &task.Payload, &task.Priority, &task.Status, &task.CreatedAt, &task.UpdatedAt, &task.Timeout, &task.RetryCount, &task.MaxRetries, &task.Result)
+		err := rows.Scan(&task.ID, &task.Type, &task.Payload, &task.Priority, &task.Status, &task.CreatedAt, &task.UpdatedAt, &task.Timeout, &task.RetryCount, &task.MaxRetries, &task.Result, &task.Progress.Percent, &task.Progress.Phase, &task.UserId, &task.OrganisationID, &task.Version)
 
 		if err != nil {
 			return nil, err
@@ -131,40 +253,189 @@ func (db *DB) ListTasks(userId int, filters Filters) ([]*Task, error) {
 	return tasks, nil
 }
 
-func (db *DB) UpdateTask(task *Task) error {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+// UpdateTask changes everything about the task but its status, which only
+// changes through the Mark methods. It returns ErrEditConflict if the task
+// was updated since it was read.
+func (db *DB) UpdateTask(ctx context.Context, task *Task) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	query := `
 		UPDATE tasks
-		SET type = $1, payload = $2, priority = $3, status = $4, timeout = $5, retry_count = $6, max_retries = $7, result = $8, updated_at = $9
-		WHERE id = $10 AND user_id = $11
-		RETURNING updated_at`
+		SET type = $1, payload = $2, priority = $3, timeout = $4, retry_count = $5, max_retries = $6, result = $7, updated_at = NOW(), version = version + 1
+		WHERE id = $8 AND version = $9
+		RETURNING updated_at, version`
 
 	err := db.QueryRowContext(ctx, query,
-		task.Type, task.Payload, task.Priority, task.Status, task.Timeout, task.RetryCount, task.MaxRetries, task.Result, time.Now(), task.ID, task.UserId).Scan(&task.UpdatedAt)
+		task.Type, task.Payload, task.Priority, task.Timeout, task.RetryCount, task.MaxRetries, task.Result, task.ID, task.Version).Scan(&task.UpdatedAt, &task.Version)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrEditConflict
+	}
+
+	return err
+}
+
+// taskTransitions lists the statuses a task may move to from each status.
+// Failed and timed out tasks can be started again by hand from the queue,
+// completed ones are done for good.
+var taskTransitions = map[string][]string{
+	TaskStatusQueued:     {TaskStatusInProgress, TaskStatusFailed},
+	TaskStatusInProgress: {TaskStatusInProgress, TaskStatusQueued, TaskStatusCompleted, TaskStatusFailed, TaskStatusTimedOut},
+	TaskStatusFailed:     {TaskStatusInProgress},
+	TaskStatusTimedOut:   {TaskStatusInProgress},
+	TaskStatusCompleted:  {},
+}
+
+// CanTransition reports whether a task may move from one status to another.
+func CanTransition(from, to string) bool {
+	for _, status := range taskTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// TaskAttempt identifies the worker and attempt changing the status of a
+// task, for the task's history.
+type TaskAttempt struct {
+	Worker  string
+	Attempt int
+}
+
+// MarkStarted moves the task to in progress.
+func (db *DB) MarkStarted(ctx context.Context, task *Task, attempt TaskAttempt) error {
+	return db.transitionTask(ctx, task, TaskStatusInProgress, &TaskEvent{Type: TaskEventStarted, Worker: attempt.Worker, Attempt: attempt.Attempt})
+}
+
+// MarkCompleted moves the task to completed, together with its result.
+func (db *DB) MarkCompleted(ctx context.Context, task *Task, attempt TaskAttempt) error {
+	return db.transitionTask(ctx, task, TaskStatusCompleted, &TaskEvent{Type: TaskEventCompleted, Worker: attempt.Worker, Attempt: attempt.Attempt})
+}
+
+// MarkFailed records a failed attempt. The status is failed or timed out if
+// the task is given up on, or queued if it is going to be retried.
+func (db *DB) MarkFailed(ctx context.Context, task *Task, attempt TaskAttempt, status, reason string) error {
+	event := &TaskEvent{Type: status, Worker: attempt.Worker, Attempt: attempt.Attempt, Details: reason}
+
+	switch status {
+	case TaskStatusQueued:
+		event.Type = TaskEventRetrying
+	case TaskStatusFailed, TaskStatusTimedOut:
+	default:
+		return fmt.Errorf("%q is not a failed status", status)
+	}
 
+	// the retry only counts once the transition is stored, so a task that
+	// failed to transition can be marked failed again
+	failed := *task
+	failed.RetryCount++
+
+	err := db.transitionTask(ctx, &failed, status, event)
 	if err != nil {
 		return err
 	}
 
+	*task = failed
 	return nil
 }
 
-func (db *DB) DeleteTask(id, userId int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+// transitionTask moves the task to status and records event in its history.
+// It returns ErrInvalidTransition if the task can't move there from its
+// current status, and ErrEditConflict if the task was updated since it was
+// read.
+func (db *DB) transitionTask(ctx context.Context, task *Task, status string, event *TaskEvent) error {
+	if !CanTransition(task.Status, status) {
+		return fmt.Errorf("%w: %s to %s", ErrInvalidTransition, task.Status, status)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	query := `
-		DELETE FROM tasks
-		WHERE id = $1 AND user_id = $2
-		`
+		UPDATE tasks
+		SET status = $1, retry_count = $2, result = $3, updated_at = NOW(), version = version + 1
+		WHERE id = $4 AND version = $5
+		RETURNING updated_at, version`
+
+	err = tx.QueryRowContext(ctx, query, status, task.RetryCount, task.Result, task.ID, task.Version).Scan(&task.UpdatedAt, &task.Version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrEditConflict
+		}
+		return err
+	}
 
-	_, err := db.ExecContext(ctx, query, id, userId)
+	event.TaskID = task.ID
 
+	err = insertTaskEvent(ctx, tx, event)
 	if err != nil {
 		return err
 	}
 
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	task.Status = status
 	return nil
 }
+
+func (db *DB) UpdateTaskProgress(ctx context.Context, id int, progress TaskProgress) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		UPDATE tasks
+		SET progress = $1, progress_phase = $2
+		WHERE id = $3`
+
+	_, err := db.ExecContext(ctx, query, progress.Percent, progress.Phase, id)
+
+	return err
+}
+
+// DeleteTaskByID deletes a task regardless of who owns it. It reports whether
+// the task existed.
+func (db *DB) DeleteTaskByID(ctx context.Context, id int) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, `DELETE FROM tasks WHERE id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// DeleteTask deletes a task the user created, or one of an organisation in
+// which they are an owner or admin. It reports whether there was such a task.
+func (db *DB) DeleteTask(ctx context.Context, id, userId int) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		DELETE FROM tasks
+		WHERE id = $1 AND (user_id = $2 OR organisation_id IN (
+			SELECT organisation_id FROM memberships WHERE user_id = $2 AND role IN ('owner', 'admin')))
+		`
+
+	result, err := db.ExecContext(ctx, query, id, userId)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
@@ -0,0 +1,147 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrRefreshTokenReused = errors.New("refresh token has already been used")
+
+// RefreshToken is a long-lived token that can be exchanged once for a new
+// access token and a new refresh token. Every token issued from the same
+// login shares a family, so a stolen token being replayed can revoke the
+// whole chain.
+type RefreshToken struct {
+	ID        int          `db:"id"`
+	UserID    int          `db:"user_id"`
+	FamilyID  string       `db:"family_id"`
+	Hash      []byte       `db:"token_hash"`
+	ExpiresAt time.Time    `db:"expires_at"`
+	CreatedAt time.Time    `db:"created_at"`
+	RevokedAt sql.NullTime `db:"revoked_at"`
+}
+
+func (db *DB) InsertRefreshToken(ctx context.Context, token *RefreshToken) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`
+
+	return db.QueryRowContext(ctx, query, token.UserID, token.FamilyID, token.Hash, token.ExpiresAt).Scan(&token.ID, &token.CreatedAt)
+}
+
+func (db *DB) GetRefreshTokenByHash(ctx context.Context, hash []byte) (*RefreshToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var token RefreshToken
+
+	query := `SELECT * FROM refresh_tokens WHERE token_hash = $1`
+
+	err := db.GetContext(ctx, &token, query, hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return &token, err
+}
+
+// RotateRefreshToken revokes old and stores its replacement atomically. It
+// returns ErrRefreshTokenReused if old was revoked in the meantime, e.g. by
+// a concurrent request presenting the same token.
+func (db *DB) RotateRefreshToken(ctx context.Context, old, replacement *RefreshToken) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL`, old.ID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrRefreshTokenReused
+	}
+
+	query := `
+		INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`
+
+	err = tx.QueryRowContext(ctx, query, replacement.UserID, replacement.FamilyID, replacement.Hash, replacement.ExpiresAt).Scan(&replacement.ID, &replacement.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *DB) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL`
+
+	_, err := db.ExecContext(ctx, query, familyID)
+	return err
+}
+
+// RevokeAccessToken denies the access token with the given jti until it
+// expires on its own. Entries of tokens that have expired since are cleaned
+// up on the way.
+func (db *DB) RevokeAccessToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `DELETE FROM revoked_access_tokens WHERE expires_at < NOW()`)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO revoked_access_tokens (jti, expires_at)
+		VALUES ($1, $2)
+		ON CONFLICT (jti) DO NOTHING`
+
+	_, err = db.ExecContext(ctx, query, jti, expiresAt)
+	return err
+}
+
+func (db *DB) IsAccessTokenRevoked(ctx context.Context, jti string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var revoked bool
+
+	query := `SELECT EXISTS (SELECT 1 FROM revoked_access_tokens WHERE jti = $1)`
+
+	err := db.GetContext(ctx, &revoked, query, jti)
+	return revoked, err
+}
+
+// RevokeUserRefreshTokens revokes every refresh token of the user, signing
+// them out everywhere once their access tokens expire.
+func (db *DB) RevokeUserRefreshTokens(ctx context.Context, userId int) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`
+
+	_, err := db.ExecContext(ctx, query, userId)
+	return err
+}
@@ -0,0 +1,67 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Upload is an image uploaded directly to the API. Its bytes live in the
+// storage backend under StorageKey.
+type Upload struct {
+	ID          string    `db:"id" json:"id"`
+	UserID      int       `db:"user_id" json:"-"`
+	ContentType string    `db:"content_type" json:"content_type"`
+	Size        int       `db:"size" json:"size"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+}
+
+func (u Upload) StorageKey() string {
+	return UploadStorageKey(u.ID)
+}
+
+func UploadStorageKey(id string) string {
+	return "uploads/" + id
+}
+
+func NewUploadID() (string, error) {
+	b := make([]byte, 16)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return "upl_" + hex.EncodeToString(b), nil
+}
+
+func (db *DB) InsertUpload(ctx context.Context, upload *Upload) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		INSERT INTO uploads (id, user_id, content_type, size)
+		VALUES ($1, $2, $3, $4)
+		RETURNING created_at`
+
+	return db.QueryRowContext(ctx, query, upload.ID, upload.UserID, upload.ContentType, upload.Size).Scan(&upload.CreatedAt)
+}
+
+func (db *DB) GetUpload(ctx context.Context, id string, userId int) (*Upload, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var upload Upload
+
+	query := `SELECT * FROM uploads WHERE id = $1 AND user_id = $2`
+
+	err := db.GetContext(ctx, &upload, query, id, userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return &upload, err
+}
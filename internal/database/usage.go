@@ -0,0 +1,137 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	QuotaActiveTasks = "active_tasks"
+	QuotaDailyTasks  = "daily_tasks"
+)
+
+// TaskQuota limits the tasks InsertTask lets the owner of a task have. Zero
+// values don't limit.
+type TaskQuota struct {
+	MaxActiveTasks int
+	MaxDailyTasks  int
+}
+
+// QuotaError is returned by InsertTask if the task would exceed a quota of
+// its owner.
+type QuotaError struct {
+	// Quota is QuotaActiveTasks or QuotaDailyTasks.
+	Quota string
+	Limit int
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota of %d %s exceeded", e.Limit, e.Quota)
+}
+
+// Usage is what a user or organisation is currently consuming, as counted
+// against the quotas of their plan.
+type Usage struct {
+	ActiveTasks  int   `json:"active_tasks"`
+	TasksToday   int   `json:"tasks_today"`
+	StorageBytes int64 `json:"storage_bytes"`
+}
+
+// GetUsage counts the user's queued and in-progress tasks, the tasks they
+// created since midnight UTC and the bytes taken by their task results.
+// Tasks of an organisation count towards the organisation instead.
+func (db *DB) GetUsage(ctx context.Context, userId int) (*Usage, error) {
+	return db.getUsage(ctx, "tasks.user_id = $1 AND tasks.organisation_id IS NULL", "user:"+strconv.Itoa(userId), userId)
+}
+
+// GetOrganisationUsage is GetUsage for the tasks shared by an organisation's
+// members.
+func (db *DB) GetOrganisationUsage(ctx context.Context, organisationId int) (*Usage, error) {
+	return db.getUsage(ctx, "tasks.organisation_id = $1", "organisation:"+strconv.Itoa(organisationId), organisationId)
+}
+
+// usageOwner is who the daily count of task counts towards.
+func usageOwner(task *Task) string {
+	if task.OrganisationID != nil {
+		return "organisation:" + strconv.Itoa(*task.OrganisationID)
+	}
+
+	return "user:" + strconv.Itoa(task.UserId)
+}
+
+// today is the current day in UTC, which daily quotas reset at.
+func today() string {
+	return time.Now().UTC().Format("2006-01-02")
+}
+
+// reserveTask counts task towards the tasks its owner created today, in tx,
+// and returns a QuotaError if that or the owner's active tasks exceed quota.
+// The update of the daily count locks the owner's row, so concurrent inserts
+// for the same owner take turns and each sees the tasks committed before it.
+func reserveTask(ctx context.Context, tx *sql.Tx, task *Task, quota TaskQuota) error {
+	query := `
+		INSERT INTO daily_task_counts (owner, day, tasks)
+		VALUES ($1, $2, 1)
+		ON CONFLICT (owner, day) DO UPDATE SET tasks = daily_task_counts.tasks + 1
+		WHERE $3 = 0 OR daily_task_counts.tasks < $3
+		RETURNING tasks`
+
+	var tasks int
+
+	err := tx.QueryRowContext(ctx, query, usageOwner(task), today(), quota.MaxDailyTasks).Scan(&tasks)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &QuotaError{Quota: QuotaDailyTasks, Limit: quota.MaxDailyTasks}
+	}
+	if err != nil {
+		return err
+	}
+
+	if quota.MaxActiveTasks == 0 {
+		return nil
+	}
+
+	owner, id := "user_id = $1 AND organisation_id IS NULL", task.UserId
+	if task.OrganisationID != nil {
+		owner, id = "organisation_id = $1", *task.OrganisationID
+	}
+
+	var active int
+
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM tasks WHERE `+owner+` AND status IN ('queued', 'in_progress')`, id).Scan(&active)
+	if err != nil {
+		return err
+	}
+
+	if active >= quota.MaxActiveTasks {
+		return &QuotaError{Quota: QuotaActiveTasks, Limit: quota.MaxActiveTasks}
+	}
+
+	return nil
+}
+
+// getUsage counts the tasks matching owner, and the tasks created today from
+// daily_task_counts, so deleting tasks doesn't reset the daily count.
+func (db *DB) getUsage(ctx context.Context, owner, counter string, id int) (*Usage, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		SELECT
+			(SELECT COUNT(*) FROM tasks WHERE ` + owner + ` AND status IN ('queued', 'in_progress')),
+			(SELECT COALESCE(SUM(tasks), 0) FROM daily_task_counts WHERE owner = $2 AND day = $3::date),
+			(SELECT COALESCE(SUM(octet_length(result)), 0) FROM tasks WHERE ` + owner + ` AND status = 'completed') +
+			(SELECT COALESCE(SUM(task_results.size), 0) FROM task_results JOIN tasks ON tasks.id = task_results.task_id WHERE ` + owner + `)`
+
+	var usage Usage
+
+	err := db.QueryRowContext(ctx, query, id, counter, today()).Scan(&usage.ActiveTasks, &usage.TasksToday, &usage.StorageBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &usage, nil
+}
@@ -5,6 +5,8 @@ import (
 	"database/sql"
 	"errors"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 type User struct {
@@ -12,12 +14,18 @@ type User struct {
 	CreatedAt    time.Time `db:"created_at" json:"created_at"`
 	UpdatedAt    time.Time `db:"updated_at" json:"updated_at"`
 	Email        string    `db:"email" json:"email"`
-	Version      int       `db:"version" json:"-"`
-	PasswordHash string    `db:"password_hash" json:"password_hash"`
+	Version      int       `db:"version" json:"version"`
+	PasswordHash string    `db:"password_hash" json:"-"`
+	Plan         string    `db:"plan" json:"plan"`
+	Role         string    `db:"role" json:"role"`
+	Activated    bool      `db:"activated" json:"activated"`
+	// PasswordChangedAt is nil if the password was never changed. Access
+	// tokens issued before it are no longer accepted.
+	PasswordChangedAt *time.Time `db:"password_changed_at" json:"-"`
 }
 
-func (db *DB) InsertUser(email, hashedPassword string) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+func (db *DB) InsertUser(ctx context.Context, email, hashedPassword string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	var id int
@@ -35,8 +43,8 @@ func (db *DB) InsertUser(email, hashedPassword string) (int, error) {
 	return id, err
 }
 
-func (db *DB) GetUser(id int) (*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+func (db *DB) GetUser(ctx context.Context, id int) (*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	var user User
@@ -51,8 +59,8 @@ func (db *DB) GetUser(id int) (*User, error) {
 	return &user, err
 }
 
-func (db *DB) GetUserByEmail(email string) (*User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+func (db *DB) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
 	var user User
@@ -67,12 +75,116 @@ func (db *DB) GetUserByEmail(email string) (*User, error) {
 	return &user, err
 }
 
-func (db *DB) UpdateUserHashedPassword(id int, hashedPassword string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+func (db *DB) UpdateUserHashedPassword(ctx context.Context, id int, hashedPassword string) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
 	defer cancel()
 
-	query := `UPDATE users SET password_hash = $1 WHERE id = $2`
+	query := `UPDATE users SET password_hash = $1, password_changed_at = clock_timestamp() WHERE id = $2`
 
 	_, err := db.ExecContext(ctx, query, hashedPassword, id)
 	return err
 }
+
+func (db *DB) ListUsers(ctx context.Context, filters Filters) ([]*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	users := []*User{}
+
+	query := `SELECT * FROM users ORDER BY id LIMIT $1 OFFSET $2`
+
+	err := db.SelectContext(ctx, &users, query, filters.limit(), filters.offset())
+	return users, err
+}
+
+func (db *DB) UpdateUserRoleAndPlan(ctx context.Context, user *User) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		UPDATE users
+		SET role = $1, plan = $2
+		WHERE id = $3
+		RETURNING updated_at, version`
+
+	return db.QueryRowContext(ctx, query, user.Role, user.Plan, user.ID).Scan(&user.UpdatedAt, &user.Version)
+}
+
+func (db *DB) ActivateUser(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `UPDATE users SET activated = true WHERE id = $1 AND NOT activated`, id)
+	return err
+}
+
+// UpdateUser saves the user's email, password hash and activation status. It
+// returns ErrEditConflict if the user was changed since they were read.
+func (db *DB) UpdateUser(ctx context.Context, user *User) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		UPDATE users
+		SET email = $1, password_hash = $2, activated = $3,
+			password_changed_at = CASE WHEN password_hash = $2 THEN password_changed_at ELSE clock_timestamp() END
+		WHERE id = $4 AND version = $5
+		RETURNING updated_at, version`
+
+	err := db.QueryRowContext(ctx, query, user.Email, user.PasswordHash, user.Activated, user.ID, user.Version).Scan(&user.UpdatedAt, &user.Version)
+
+	var pqErr *pq.Error
+
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrEditConflict
+	case errors.As(err, &pqErr) && pqErr.Code == "23505":
+		return ErrDuplicateEmail
+	}
+
+	return err
+}
+
+// DeleteUser deletes the user with everything they own: their tasks and task
+// results, uploads, tokens, API keys, memberships and any organisation they
+// were the only member of. It returns the IDs of the deleted uploads, whose
+// images are left for the caller to remove from storage.
+func (db *DB) DeleteUser(ctx context.Context, id int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	uploadIDs := []string{}
+
+	err = tx.SelectContext(ctx, &uploadIDs, `SELECT id FROM uploads WHERE user_id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM tasks WHERE user_id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		DELETE FROM organisations
+		WHERE id IN (SELECT organisation_id FROM memberships WHERE user_id = $1)
+		AND NOT EXISTS (SELECT 1 FROM memberships WHERE organisation_id = organisations.id AND user_id <> $1)`
+
+	_, err = tx.ExecContext(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return uploadIDs, tx.Commit()
+}
@@ -0,0 +1,69 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const (
+	UserTokenScopeActivation    = "activation"
+	UserTokenScopePasswordReset = "password-reset"
+)
+
+// InsertUserToken stores the hash of a single-use token sent to the user by
+// email, such as an activation or password reset token.
+func (db *DB) InsertUserToken(ctx context.Context, hash []byte, userId int, scope string, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	query := `
+		INSERT INTO user_tokens (token_hash, user_id, scope, expires_at)
+		VALUES ($1, $2, $3, $4)`
+
+	_, err := db.ExecContext(ctx, query, hash, userId, scope, expiresAt)
+	return err
+}
+
+// ConsumeUserToken deletes the token and returns the user it was issued to,
+// or nil if there is no unexpired token with that hash and scope. A token can
+// only be consumed once, even by concurrent requests.
+func (db *DB) ConsumeUserToken(ctx context.Context, hash []byte, scope string) (*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	var userId int
+
+	query := `
+		DELETE FROM user_tokens
+		WHERE token_hash = $1 AND scope = $2 AND expires_at > NOW()
+		RETURNING user_id`
+
+	err := db.GetContext(ctx, &userId, query, hash, scope)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var user User
+
+	err = db.GetContext(ctx, &user, `SELECT * FROM users WHERE id = $1`, userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	return &user, err
+}
+
+// DeleteUserTokens deletes all tokens of the user with the given scope, along
+// with any expired token of theirs.
+func (db *DB) DeleteUserTokens(ctx context.Context, userId int, scope string) error {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `DELETE FROM user_tokens WHERE user_id = $1 AND (scope = $2 OR expires_at <= NOW())`, userId, scope)
+	return err
+}
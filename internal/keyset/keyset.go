@@ -0,0 +1,190 @@
+package keyset
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/pascaldekloe/jwt"
+)
+
+// JWK is the public half of a signing key as published in a JWK Set.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+// Keyset signs JWTs with a single key and checks them against that key and
+// any retired ones. Retired keys should be kept until the last token they
+// signed has expired, so keys can be rotated without logging anybody out.
+// Every token carries the ID of its key in the "kid" header.
+type Keyset struct {
+	signingKeyID string
+	sign         func(claims *jwt.Claims, header json.RawMessage) ([]byte, error)
+	register     jwt.KeyRegister
+	keys         []JWK
+}
+
+func New() *Keyset {
+	return &Keyset{}
+}
+
+// AddSecret adds an HS256 secret. Secrets are never published in the JWK Set,
+// so only this API can check tokens signed with one.
+func (ks *Keyset) AddSecret(secret []byte, signing bool) error {
+	if len(secret) == 0 {
+		return errors.New("keyset: empty secret")
+	}
+
+	sum := sha256.Sum256(secret)
+	kid := "hs256-" + hex.EncodeToString(sum[:8])
+
+	ks.register.Secrets = append(ks.register.Secrets, secret)
+	ks.register.SecretIDs = append(ks.register.SecretIDs, kid)
+
+	if signing {
+		ks.setSigner(kid, func(claims *jwt.Claims, header json.RawMessage) ([]byte, error) {
+			return claims.HMACSign(jwt.HS256, secret, header)
+		})
+	}
+
+	return nil
+}
+
+// LoadFile adds the Ed25519 or RSA key PEM encoded in the file at path. Ed25519
+// keys sign with EdDSA and RSA keys with RS256. The signing key has to be a
+// private key, retired keys may also be public keys.
+func (ks *Keyset) LoadFile(path string, signing bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("keyset: no PEM data found in %s", path)
+	}
+
+	key, err := parseKey(block)
+	if err != nil {
+		return fmt.Errorf("keyset: %s: %w", path, err)
+	}
+
+	var public crypto.PublicKey = key
+	if signer, ok := key.(crypto.Signer); ok {
+		public = signer.Public()
+	} else if signing {
+		return fmt.Errorf("keyset: %s: the signing key must be a private key", path)
+	}
+
+	switch public := public.(type) {
+	case ed25519.PublicKey:
+		jwk := JWK{KeyType: "OKP", Algorithm: jwt.EdDSA, Use: "sig", Curve: "Ed25519", X: encode(public)}
+		jwk.KeyID = thumbprint(fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":%q}`, jwk.X))
+
+		ks.register.EdDSAs = append(ks.register.EdDSAs, public)
+		ks.register.EdDSAIDs = append(ks.register.EdDSAIDs, jwk.KeyID)
+		ks.keys = append(ks.keys, jwk)
+
+		if signing {
+			private := key.(ed25519.PrivateKey)
+			ks.setSigner(jwk.KeyID, func(claims *jwt.Claims, header json.RawMessage) ([]byte, error) {
+				return claims.EdDSASign(private, header)
+			})
+		}
+	case *rsa.PublicKey:
+		jwk := JWK{KeyType: "RSA", Algorithm: jwt.RS256, Use: "sig", N: encode(public.N.Bytes()), E: encode(big.NewInt(int64(public.E)).Bytes())}
+		jwk.KeyID = thumbprint(fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, jwk.E, jwk.N))
+
+		ks.register.RSAs = append(ks.register.RSAs, public)
+		ks.register.RSAIDs = append(ks.register.RSAIDs, jwk.KeyID)
+		ks.keys = append(ks.keys, jwk)
+
+		if signing {
+			private := key.(*rsa.PrivateKey)
+			ks.setSigner(jwk.KeyID, func(claims *jwt.Claims, header json.RawMessage) ([]byte, error) {
+				return claims.RSASign(jwt.RS256, private, header)
+			})
+		}
+	default:
+		return fmt.Errorf("keyset: %s: unsupported key type %T, expected Ed25519 or RSA", path, public)
+	}
+
+	return nil
+}
+
+func (ks *Keyset) setSigner(kid string, sign func(claims *jwt.Claims, header json.RawMessage) ([]byte, error)) {
+	ks.signingKeyID = kid
+	ks.sign = sign
+}
+
+// Sign signs claims with the signing key.
+func (ks *Keyset) Sign(claims *jwt.Claims) ([]byte, error) {
+	if ks.sign == nil {
+		return nil, errors.New("keyset: no signing key")
+	}
+
+	header, err := json.Marshal(map[string]string{"kid": ks.signingKeyID})
+	if err != nil {
+		return nil, err
+	}
+
+	return ks.sign(claims, header)
+}
+
+// Check parses token if it was signed by any key of the set. Like
+// jwt.KeyRegister.Check it does not check the claims themselves.
+func (ks *Keyset) Check(token []byte) (*jwt.Claims, error) {
+	return ks.register.Check(token)
+}
+
+// JWKS returns the public keys of the set, in the format served at
+// /.well-known/jwks.json.
+func (ks *Keyset) JWKS() map[string][]JWK {
+	keys := make([]JWK, len(ks.keys))
+	copy(keys, ks.keys)
+
+	return map[string][]JWK{"keys": keys}
+}
+
+func parseKey(block *pem.Block) (any, error) {
+	switch block.Type {
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// thumbprint returns the RFC 7638 thumbprint of a JWK given its required
+// members in lexicographic order, used as the key ID.
+func thumbprint(members string) string {
+	sum := sha256.Sum256([]byte(members))
+	return encode(sum[:])
+}
@@ -0,0 +1,37 @@
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// LogMailer writes every email to w instead of sending it, for local
+// development and testing. w is usually os.Stdout or an append-only file.
+type LogMailer struct {
+	mu     sync.Mutex
+	w      io.Writer
+	sender string
+}
+
+func NewLogMailer(w io.Writer, sender string) *LogMailer {
+	return &LogMailer{w: w, sender: sender}
+}
+
+func (m *LogMailer) Send(recipient, templateFile string, data any) error {
+	e, err := render(templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	msg, err := e.message(m.sender, recipient)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err = fmt.Fprintf(m.w, "%s\r\n\r\n", msg)
+	return err
+}
@@ -0,0 +1,113 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/Babatunde50/distributask/assets"
+)
+
+// Mailer sends the email rendered from one of the templates in assets/emails.
+// Every template defines a "subject", "plainBody" and "htmlBody".
+type Mailer interface {
+	Send(recipient, templateFile string, data any) error
+}
+
+type email struct {
+	subject   string
+	plainBody string
+	htmlBody  string
+}
+
+// render executes the subject and plain text body as text templates, and only
+// the HTML body as an HTML template, so the text isn't HTML escaped.
+func render(templateFile string, data any) (*email, error) {
+	pattern := "emails/" + templateFile
+
+	text, err := texttemplate.New("").ParseFS(assets.EmbeddedFiles, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	html, err := template.New("").ParseFS(assets.EmbeddedFiles, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var subject, plainBody, htmlBody bytes.Buffer
+
+	err = text.ExecuteTemplate(&subject, "subject", data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = text.ExecuteTemplate(&plainBody, "plainBody", data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = html.ExecuteTemplate(&htmlBody, "htmlBody", data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &email{subject: subject.String(), plainBody: plainBody.String(), htmlBody: htmlBody.String()}, nil
+}
+
+// message returns e as a multipart/alternative MIME message with both a
+// plain text and an HTML body.
+func (e *email) message(sender, recipient string) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=UTF-8", e.plainBody},
+		{"text/html; charset=UTF-8", e.htmlBody},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		qw := quotedprintable.NewWriter(w)
+
+		_, err = qw.Write([]byte(part.content))
+		if err != nil {
+			return nil, err
+		}
+
+		err = qw.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := mw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+
+	fmt.Fprintf(&msg, "From: %s\r\n", sender)
+	fmt.Fprintf(&msg, "To: %s\r\n", recipient)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", e.subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%q\r\n", mw.Boundary())
+	fmt.Fprintf(&msg, "\r\n")
+
+	msg.Write(body.Bytes())
+
+	return msg.Bytes(), nil
+}
@@ -0,0 +1,53 @@
+package mailer
+
+import (
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+)
+
+// SMTPMailer delivers email through an SMTP server, upgrading the connection
+// with STARTTLS when the server supports it.
+type SMTPMailer struct {
+	addr   string
+	auth   smtp.Auth
+	sender string
+	from   string
+}
+
+// NewSMTPMailer returns a mailer sending as sender, e.g.
+// "Distributask <no-reply@example.com>". No authentication is attempted if
+// username is empty.
+func NewSMTPMailer(host string, port int, username, password, sender string) (*SMTPMailer, error) {
+	from, err := mail.ParseAddress(sender)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &SMTPMailer{
+		addr:   net.JoinHostPort(host, strconv.Itoa(port)),
+		sender: sender,
+		from:   from.Address,
+	}
+
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return m, nil
+}
+
+func (m *SMTPMailer) Send(recipient, templateFile string, data any) error {
+	e, err := render(templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	msg, err := e.message(m.sender, recipient)
+	if err != nil {
+		return err
+	}
+
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{recipient}, msg)
+}
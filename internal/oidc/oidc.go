@@ -0,0 +1,291 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pascaldekloe/jwt"
+)
+
+var ErrInvalidIDToken = errors.New("oidc: invalid ID token")
+
+// Config identifies this API as a client of an OpenID Connect provider.
+// ClientSecret may be empty for public clients relying on PKCE alone.
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// IDToken holds the claims of a verified ID token this API relies on.
+type IDToken struct {
+	Issuer        string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Nonce         string
+}
+
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider runs the authorization code flow with PKCE against the provider
+// at Config.Issuer. Its metadata and signing keys are fetched on first use,
+// so the API starts even while the provider is unreachable.
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mu       sync.Mutex
+	metadata *metadata
+	keys     *jwt.KeyRegister
+	keysAt   time.Time
+}
+
+func New(config Config) *Provider {
+	return &Provider{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// NewVerifier returns a random PKCE code verifier.
+func NewVerifier() (string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// AuthCodeURL returns the URL to send the user to for logging in. The
+// code challenge is derived from verifier with S256.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	m, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(m.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return m.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange redeems an authorization code and returns the verified ID token
+// that came with it. nonce must be the one the login was started with.
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*IDToken, error) {
+	m, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {verifier},
+	}
+	if p.config.ClientSecret != "" {
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+
+	status, err := p.doJSON(req, &tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	if status != http.StatusOK || tokens.IDToken == "" {
+		return nil, fmt.Errorf("oidc: token request failed with status %d: %s %s", status, tokens.Error, tokens.ErrorDescription)
+	}
+
+	return p.verify(ctx, m, []byte(tokens.IDToken), nonce)
+}
+
+func (p *Provider) verify(ctx context.Context, m *metadata, token []byte, nonce string) (*IDToken, error) {
+	keys, err := p.signingKeys(ctx, m, false)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := keys.Check(token)
+	if errors.Is(err, jwt.ErrSigMiss) {
+		// the provider may have rotated its keys since they were fetched
+		keys, err = p.signingKeys(ctx, m, true)
+		if err != nil {
+			return nil, err
+		}
+
+		claims, err = keys.Check(token)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	if claims.Issuer != m.Issuer || !claims.AcceptAudience(p.config.ClientID) || claims.AcceptTemporal(time.Now(), time.Minute) != nil {
+		return nil, ErrInvalidIDToken
+	}
+
+	idToken := IDToken{Issuer: claims.Issuer, Subject: claims.Subject}
+	idToken.Nonce, _ = claims.String("nonce")
+	idToken.Email, _ = claims.String("email")
+
+	if idToken.Subject == "" || idToken.Nonce != nonce {
+		return nil, ErrInvalidIDToken
+	}
+
+	// some providers send email_verified as a string
+	switch verified := claims.Set["email_verified"].(type) {
+	case bool:
+		idToken.EmailVerified = verified
+	case string:
+		idToken.EmailVerified = verified == "true"
+	}
+
+	return &idToken, nil
+}
+
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(p.config.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var m metadata
+
+	status, err := p.doJSON(req, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("oidc: discovery failed with status %d", status)
+	}
+
+	if m.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("oidc: provider issuer %q doesn't match %q", m.Issuer, p.config.Issuer)
+	}
+
+	if m.AuthorizationEndpoint == "" || m.TokenEndpoint == "" || m.JWKSURI == "" {
+		return nil, errors.New("oidc: incomplete provider metadata")
+	}
+
+	p.metadata = &m
+
+	return p.metadata, nil
+}
+
+// signingKeys returns the provider's keys, fetching them if they haven't
+// been yet or, when refresh is set, if they are more than a minute old.
+func (p *Provider) signingKeys(ctx context.Context, m *metadata, refresh bool) (*jwt.KeyRegister, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.keys != nil && (!refresh || time.Since(p.keysAt) < time.Minute) {
+		return p.keys, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw json.RawMessage
+
+	status, err := p.doJSON(req, &raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("oidc: fetching signing keys failed with status %d", status)
+	}
+
+	var keys jwt.KeyRegister
+
+	_, err = keys.LoadJWK(raw)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: invalid signing keys: %w", err)
+	}
+
+	p.keys = &keys
+	p.keysAt = time.Now()
+
+	return p.keys, nil
+}
+
+func (p *Provider) doJSON(req *http.Request, dst any) (int, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return 0, err
+	}
+
+	err = json.Unmarshal(body, dst)
+	if err != nil && resp.StatusCode == http.StatusOK {
+		return 0, fmt.Errorf("oidc: invalid response from %s: %w", req.URL, err)
+	}
+
+	return resp.StatusCode, nil
+}
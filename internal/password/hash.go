@@ -28,3 +28,12 @@ func Matches(plaintextPassword, hashedPassword string) (bool, error) {
 
 	return true, nil
 }
+
+// dummyHash is a hash of a random password with the same cost as real ones.
+const dummyHash = "$2a$12$Cm.dR0AuFHBCmCLyatxfVuW249K8dhNnTtGEEYGe0sJj/3.RspjKO"
+
+// DummyMatches takes as long as Matches does for an existing user, so a login
+// with an unknown email can't be told apart by how long it takes to fail.
+func DummyMatches(plaintextPassword string) {
+	bcrypt.CompareHashAndPassword([]byte(dummyHash), []byte(plaintextPassword))
+}
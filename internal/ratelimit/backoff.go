@@ -0,0 +1,122 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// BackoffPolicy lets a key fail Free times without waiting. Every failure
+// after that makes it wait Delay, doubling with each further failure up to
+// MaxDelay, and from Lockout failures on it is locked out for
+// LockoutDuration. Failures are forgotten after a Window without any.
+type BackoffPolicy struct {
+	Free            int
+	Delay           time.Duration
+	MaxDelay        time.Duration
+	Lockout         int
+	LockoutDuration time.Duration
+	Window          time.Duration
+}
+
+// The failures of a key are stored in a hash together with the time until
+// which it has to wait, using Redis' clock like the token bucket.
+var backoffFail = redis.NewScript(`
+local free = tonumber(ARGV[1])
+local delay = tonumber(ARGV[2])
+local max_delay = tonumber(ARGV[3])
+local lockout = tonumber(ARGV[4])
+local lockout_duration = tonumber(ARGV[5])
+local window = tonumber(ARGV[6])
+
+local time = redis.call("TIME")
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+
+local failures = redis.call("HINCRBY", KEYS[1], "failures", 1)
+
+local wait = 0
+
+if lockout > 0 and failures >= lockout then
+	wait = lockout_duration
+elseif failures > free then
+	wait = math.min(max_delay, delay * 2 ^ (failures - free - 1))
+end
+
+redis.call("HSET", KEYS[1], "wait_until", tostring(now + wait))
+redis.call("EXPIRE", KEYS[1], math.ceil(math.max(window, wait)))
+
+return tostring(wait)
+`)
+
+var backoffWait = redis.NewScript(`
+local wait_until = tonumber(redis.call("HGET", KEYS[1], "wait_until"))
+
+if wait_until == nil then
+	return "0"
+end
+
+local time = redis.call("TIME")
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+
+return tostring(math.max(0, wait_until - now))
+`)
+
+// Backoff slows down and eventually locks out repeated failed attempts, such
+// as password guesses, per key and across every API replica. A nil Backoff
+// never makes anybody wait, for running without Redis.
+type Backoff struct {
+	client redis.UniversalClient
+	prefix string
+	policy BackoffPolicy
+}
+
+func NewBackoff(client redis.UniversalClient, policy BackoffPolicy) *Backoff {
+	return &Backoff{client: client, prefix: "backoff:", policy: policy}
+}
+
+// Wait returns how long key has to wait before its next attempt, or zero if
+// it may try now.
+func (b *Backoff) Wait(ctx context.Context, key string) (time.Duration, error) {
+	if b == nil {
+		return 0, nil
+	}
+
+	return b.run(ctx, backoffWait, key)
+}
+
+// Fail records a failed attempt of key and returns how long it has to wait
+// before the next one.
+func (b *Backoff) Fail(ctx context.Context, key string) (time.Duration, error) {
+	if b == nil {
+		return 0, nil
+	}
+
+	p := b.policy
+	return b.run(ctx, backoffFail, key, p.Free, p.Delay.Seconds(), p.MaxDelay.Seconds(), p.Lockout, p.LockoutDuration.Seconds(), p.Window.Seconds())
+}
+
+// Reset forgets the failed attempts of key, e.g. after it succeeded.
+func (b *Backoff) Reset(ctx context.Context, key string) error {
+	if b == nil {
+		return nil
+	}
+
+	return b.client.Del(ctx, b.prefix+key).Err()
+}
+
+func (b *Backoff) run(ctx context.Context, script *redis.Script, key string, args ...any) (time.Duration, error) {
+	s, err := script.Run(ctx, b.client, []string{b.prefix + key}, args...).Text()
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("ratelimit: unexpected script result %q", s)
+	}
+
+	return seconds(f), nil
+}
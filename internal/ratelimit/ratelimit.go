@@ -0,0 +1,126 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Limit is a token bucket refilled at Rate tokens per second that holds at
+// most Burst tokens.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l Limit) String() string {
+	return fmt.Sprintf("%g:%d", l.Rate, l.Burst)
+}
+
+// ParseLimit parses a limit written as "rate:burst", e.g. "2:10".
+func ParseLimit(s string) (Limit, error) {
+	var limit Limit
+
+	_, err := fmt.Sscanf(s, "%g:%d", &limit.Rate, &limit.Burst)
+	if err != nil || limit.Rate <= 0 || limit.Burst < 1 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q, expected rate:burst", s)
+	}
+
+	return limit, nil
+}
+
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration
+	ResetAfter time.Duration
+}
+
+// The bucket is stored as a hash of the remaining tokens and the time they
+// were counted. Redis' own clock is used so API replicas with drifting
+// clocks still share one view of every bucket.
+var tokenBucket = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+
+local time = redis.call("TIME")
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+
+if tokens == nil then
+	tokens = burst
+	ts = now
+end
+
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+
+local allowed = 0
+local retry_after = 0
+
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry_after = (1 - tokens) / rate
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(now))
+redis.call("EXPIRE", KEYS[1], math.ceil(burst / rate) + 1)
+
+return {allowed, tostring(tokens), tostring(retry_after), tostring((burst - tokens) / rate)}
+`)
+
+// Limiter is a token bucket rate limiter backed by Redis, so limits hold
+// across every API replica.
+type Limiter struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+func NewLimiter(client redis.UniversalClient) *Limiter {
+	return &Limiter{client: client, prefix: "ratelimit:"}
+}
+
+// Allow takes a token from the bucket identified by key.
+func (l *Limiter) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	values, err := tokenBucket.Run(ctx, l.client, []string{l.prefix + key}, limit.Rate, limit.Burst).Slice()
+	if err != nil {
+		return Result{}, err
+	}
+
+	if len(values) != 4 {
+		return Result{}, fmt.Errorf("ratelimit: unexpected script result %v", values)
+	}
+
+	allowed, _ := values[0].(int64)
+
+	var floats [3]float64
+	for i := range floats {
+		s, _ := values[i+1].(string)
+
+		floats[i], err = strconv.ParseFloat(s, 64)
+		if err != nil {
+			return Result{}, fmt.Errorf("ratelimit: unexpected script result %v", values)
+		}
+	}
+
+	return Result{
+		Allowed:    allowed == 1,
+		Limit:      limit.Burst,
+		Remaining:  int(math.Floor(floats[0])),
+		RetryAfter: seconds(floats[1]),
+		ResetAfter: seconds(floats[2]),
+	}, nil
+}
+
+func seconds(f float64) time.Duration {
+	return time.Duration(f * float64(time.Second))
+}
@@ -0,0 +1,42 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+)
+
+// Generate returns a random plaintext token starting with prefix, together
+// with the hash to store in place of the token itself.
+func Generate(prefix string) (string, []byte, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", nil, err
+	}
+
+	plaintext := prefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+
+	return plaintext, Hash(plaintext), nil
+}
+
+// Hash returns the SHA-256 hash of a plaintext token. Tokens carry 256 bits
+// of randomness, so a fast unsalted hash is enough to store them safely.
+func Hash(plaintext string) []byte {
+	hash := sha256.Sum256([]byte(plaintext))
+	return hash[:]
+}
+
+// RandomID returns a random hex encoded identifier, such as a JWT ID.
+func RandomID() (string, error) {
+	b := make([]byte, 16)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
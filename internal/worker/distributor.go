@@ -2,7 +2,11 @@ package worker
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"time"
 
+	"github.com/Babatunde50/distributask/internal/database"
 	"github.com/hibiken/asynq"
 )
 
@@ -12,6 +16,15 @@ type TaskDistributor interface {
 		payload *PayloadSendTask,
 		opts ...asynq.Option,
 	) error
+	DistributeTaskSendEmail(
+		ctx context.Context,
+		payload *PayloadSendEmail,
+		opts ...asynq.Option,
+	) error
+	DistributeOutboxMessage(
+		ctx context.Context,
+		message *database.OutboxMessage,
+	) error
 }
 
 type RedisTaskDistributor struct {
@@ -22,3 +35,25 @@ func NewRedisTaskDistributor(redisOpt asynq.RedisClientOpt) TaskDistributor {
 	client := asynq.NewClient(redisOpt)
 	return &RedisTaskDistributor{client: client}
 }
+
+// DistributeOutboxMessage enqueues a message relayed from the outbox under
+// its queue ID, so a message relayed twice, for example because marking it
+// sent failed, is only enqueued once.
+func (distributor *RedisTaskDistributor) DistributeOutboxMessage(ctx context.Context, message *database.OutboxMessage) error {
+	opts := []asynq.Option{
+		asynq.TaskID(message.QueueID()),
+		asynq.Queue(message.Queue),
+		asynq.MaxRetry(message.MaxRetry),
+	}
+
+	if message.Timeout > 0 {
+		opts = append(opts, asynq.Timeout(time.Duration(message.Timeout)*time.Second))
+	}
+
+	_, err := distributor.client.EnqueueContext(ctx, asynq.NewTask(message.Type, message.Payload, opts...))
+	if err != nil && !errors.Is(err, asynq.ErrTaskIDConflict) {
+		return fmt.Errorf("failed to enqueue outbox message: %w", err)
+	}
+
+	return nil
+}
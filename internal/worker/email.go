@@ -0,0 +1,51 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hibiken/asynq"
+)
+
+const TaskSendEmail = "task:send_email"
+
+type PayloadSendEmail struct {
+	Recipient    string         `json:"recipient"`
+	TemplateFile string         `json:"template_file"`
+	Data         map[string]any `json:"data"`
+}
+
+func (distributor *RedisTaskDistributor) DistributeTaskSendEmail(
+	ctx context.Context,
+	payload *PayloadSendEmail,
+	opts ...asynq.Option,
+) error {
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal email payload: %w", err)
+	}
+
+	task := asynq.NewTask(TaskSendEmail, jsonPayload, opts...)
+
+	_, err = distributor.client.EnqueueContext(ctx, task)
+	if err != nil {
+		return fmt.Errorf("failed to enqueue email: %w", err)
+	}
+
+	return nil
+}
+
+func (processor *baseProcessor) ProcessTaskSendEmail(ctx context.Context, task *asynq.Task) error {
+	var payload PayloadSendEmail
+	if err := json.Unmarshal(task.Payload(), &payload); err != nil {
+		return fmt.Errorf("failed to unmarshal payload: %w", asynq.SkipRetry)
+	}
+
+	err := processor.mailer.Send(payload.Recipient, payload.TemplateFile, payload.Data)
+	if err != nil {
+		return fmt.Errorf("failed to send %s email: %w", payload.TemplateFile, err)
+	}
+
+	return nil
+}
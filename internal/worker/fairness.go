@@ -0,0 +1,128 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/Babatunde50/distributask/internal/database"
+	"github.com/go-redis/redis/v8"
+	"github.com/hibiken/asynq"
+)
+
+// errUserAtCapacity is returned by the fairness middleware when the task's
+// owner already has as many tasks running as they're allowed to. It isn't
+// counted as a failure: the task goes back to the queue after a short delay
+// and the worker moves on to somebody else's task.
+var errUserAtCapacity = errors.New("user has too many tasks in flight")
+
+// QueueForPriority maps a task priority to one of the priority tier queues
+// served by the processor.
+func QueueForPriority(priority int) string {
+	switch {
+	case priority >= database.TaskPriorityHigh:
+		return QueueCritical
+	case priority == database.TaskPriorityDefault:
+		return QueueDefault
+	default:
+		return QueueLow
+	}
+}
+
+// Slots are stored per user as a sorted set of task IDs scored by the time
+// their lease runs out, so the slots of a crashed worker free themselves.
+var acquireSlot = redis.NewScript(`
+local time = redis.call("TIME")
+local now = tonumber(time[1])
+
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now)
+
+if not redis.call("ZSCORE", KEYS[1], ARGV[1]) and redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[2]) then
+	return 0
+end
+
+redis.call("ZADD", KEYS[1], now + tonumber(ARGV[3]), ARGV[1])
+
+-- the key lives as long as its longest lease, a short lease mustn't expire
+-- the slots of longer running tasks with it
+local last = redis.call("ZRANGE", KEYS[1], -1, -1, "WITHSCORES")
+redis.call("EXPIRE", KEYS[1], math.ceil(tonumber(last[2]) - now))
+
+return 1
+`)
+
+// inFlightLimiter caps how many tasks of a single user run at the same time
+// across every worker sharing the Redis instance.
+type inFlightLimiter struct {
+	client   redis.UniversalClient
+	maxTasks int
+}
+
+func inFlightKey(userID int) string {
+	return "inflight:user:" + strconv.Itoa(userID)
+}
+
+// userGroup is the group the Postgres queue caps a user's tasks by, like
+// inFlightLimiter does with Redis.
+func userGroup(userID int) string {
+	return "user:" + strconv.Itoa(userID)
+}
+
+func (l *inFlightLimiter) acquire(ctx context.Context, payload PayloadSendTask, lease time.Duration) (bool, error) {
+	ok, err := acquireSlot.Run(ctx, l.client, []string{inFlightKey(payload.UserID)}, payload.TaskID, l.maxTasks, int(lease.Seconds())+1).Int()
+	if err != nil {
+		return false, err
+	}
+
+	return ok == 1, nil
+}
+
+func (l *inFlightLimiter) release(payload PayloadSendTask) error {
+	// the task's context may already be done, releasing must happen anyway
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return l.client.ZRem(ctx, inFlightKey(payload.UserID), payload.TaskID).Err()
+}
+
+// middleware only lets a task run if its owner has a free slot.
+func (l *inFlightLimiter) middleware(h asynq.Handler) asynq.Handler {
+	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
+		if l.maxTasks <= 0 {
+			return h.ProcessTask(ctx, t)
+		}
+
+		var payload PayloadSendTask
+		if err := json.Unmarshal(t.Payload(), &payload); err != nil {
+			return fmt.Errorf("failed to unmarshal payload: %w", asynq.SkipRetry)
+		}
+
+		lease := time.Minute
+		if deadline, ok := ctx.Deadline(); ok {
+			lease = time.Until(deadline)
+		}
+
+		ok, err := l.acquire(ctx, payload, lease)
+		if err != nil {
+			return fmt.Errorf("failed to acquire in-flight slot: %w", err)
+		}
+
+		if !ok {
+			return errUserAtCapacity
+		}
+
+		defer l.release(payload)
+
+		return h.ProcessTask(ctx, t)
+	})
+}
+
+// deferDelay spreads deferred tasks out a little so a user's backlog
+// doesn't come back all at once.
+func deferDelay() time.Duration {
+	return time.Second + time.Duration(rand.Int63n(int64(2*time.Second)))
+}
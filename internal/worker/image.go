@@ -1,16 +1,35 @@
 package worker
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 
 	"github.com/Babatunde50/distributask/internal/database"
+	"github.com/Babatunde50/distributask/internal/fetcher"
+	"github.com/Babatunde50/distributask/internal/storage"
 	"github.com/h2non/bimg"
+	"github.com/hibiken/asynq"
 )
 
-func doTask(dbTask *database.Task, db *database.DB, fn func() ([]byte, error)) error {
+// imageInfo is the result of the Inspect operation.
+type imageInfo struct {
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Format      string    `json:"format"`
+	ColourSpace string    `json:"colour_space"`
+	Channels    int       `json:"channels"`
+	Alpha       bool      `json:"alpha"`
+	Profile     bool      `json:"profile"`
+	Orientation int       `json:"orientation"`
+	EXIF        bimg.EXIF `json:"exif"`
+}
+
+// doTask runs fn and sets its image as the task's result, which is saved when
+// the task is marked completed.
+func doTask(ctx context.Context, dbTask *database.Task, progress *progressReporter, fn func() ([]byte, error)) error {
 
 	updatedImage, err := fn()
 
@@ -18,42 +37,115 @@ func doTask(dbTask *database.Task, db *database.DB, fn func() ([]byte, error)) e
 		return err
 	}
 
+	// image operations can't be interrupted, so make sure the task is still
+	// wanted before recording the result
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	progress.Report(ctx, 80, PhaseUploading)
+
 	encoded := base64.StdEncoding.EncodeToString(updatedImage)
 
 	dbTask.Result = encoded
 
-	dbTask.Status = "completed"
+	return nil
+}
+
+// withPayloadOptions applies the options shared by every transform to o.
+// Auto-orientation happens before any other transform, so crops and flips
+// are relative to the image as it is meant to be displayed.
+func withPayloadOptions(payload database.Payload, o bimg.Options) bimg.Options {
+	o.NoAutoRotate = !payload.AutoOrients()
+	o.StripMetadata = payload.StripMetadata
+	return o
+}
+
+func inspectImage(data []byte) (string, error) {
+	metadata, err := bimg.Metadata(data)
+
+	if err != nil {
+		return "", fmt.Errorf("error reading image metadata: %v", err)
+	}
+
+	info := imageInfo{
+		Width:       metadata.Size.Width,
+		Height:      metadata.Size.Height,
+		Format:      metadata.Type,
+		ColourSpace: metadata.Space,
+		Channels:    metadata.Channels,
+		Alpha:       metadata.Alpha,
+		Profile:     metadata.Profile,
+		Orientation: metadata.Orientation,
+		EXIF:        metadata.EXIF,
+	}
 
-	err = db.UpdateTask(dbTask)
+	js, err := json.Marshal(info)
 
 	if err != nil {
-		return fmt.Errorf("error updating task: %v", err)
+		return "", err
 	}
 
-	return nil
+	return string(js), nil
 }
 
-func imageHandler(db *database.DB, dbTask *database.Task) error {
-	imageURL := dbTask.Payload.URL
+// readImage returns the source image of a task, either from the storage
+// backend for uploaded images or by downloading it from its URL.
+func readImage(ctx context.Context, store storage.Storage, fetch *fetcher.Fetcher, payload database.Payload) ([]byte, error) {
+	if payload.UploadID != "" {
+		object, err := store.Get(ctx, database.UploadStorageKey(payload.UploadID))
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to open upload %s: %w", payload.UploadID, err)
+		}
+
+		defer object.Close()
+
+		data, err := ioutil.ReadAll(object)
 
-	res, err := http.Get(imageURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upload %s: %v", payload.UploadID, err)
+		}
+
+		return data, nil
+	}
+
+	data, err := fetch.Fetch(ctx, payload.URL)
 
 	if err != nil {
-		return err
+		if fetcher.Permanent(err) {
+			return nil, fmt.Errorf("failed to download image: %v: %w", err, asynq.SkipRetry)
+		}
+		return nil, fmt.Errorf("failed to download image: %w", err)
 	}
 
-	defer res.Body.Close()
+	return data, nil
+}
+
+// imageHandler runs an image task. ctx carries the deadline configured with
+// asynq.Timeout and is cancelled when the worker shuts down. Reaching 100% is
+// left to the caller, once the task is marked completed.
+func imageHandler(ctx context.Context, tasks database.TaskStore, store storage.Storage, fetch *fetcher.Fetcher, progress *progressReporter, dbTask *database.Task) error {
+	progress.Report(ctx, 0, PhaseDownloading)
 
-	data, err := ioutil.ReadAll(res.Body)
+	data, err := readImage(ctx, store, fetch, dbTask.Payload)
 
 	if err != nil {
-		return fmt.Errorf("failed to read image: %v", err)
+		return err
 	}
 
-	switch dbTask.Payload.Operation {
+	progress.Report(ctx, 40, PhaseTransforming)
+
+	payload := dbTask.Payload
+
+	switch payload.Operation {
 	case database.Resize:
-		return doTask(dbTask, db, func() ([]byte, error) {
-			resizedImage, err := bimg.NewImage(data).Resize(dbTask.Payload.Params.ResizeParams.Width, dbTask.Payload.Params.ResizeParams.Height)
+		return doTask(ctx, dbTask, progress, func() ([]byte, error) {
+			resizedImage, err := bimg.NewImage(data).Process(withPayloadOptions(payload, bimg.Options{
+				Width:  payload.Params.ResizeParams.Width,
+				Height: payload.Params.ResizeParams.Height,
+				Embed:  true,
+			}))
 
 			if err != nil {
 				return nil, fmt.Errorf("error resizing image: %v", err)
@@ -63,8 +155,15 @@ func imageHandler(db *database.DB, dbTask *database.Task) error {
 		})
 
 	case database.Crop:
-		return doTask(dbTask, db, func() ([]byte, error) {
-			croppedImage, err := bimg.NewImage(data).Crop(dbTask.Payload.Params.CropParams.X, dbTask.Payload.Params.CropParams.Y, bimg.GravityCentre)
+		return doTask(ctx, dbTask, progress, func() ([]byte, error) {
+			// the area is extracted after auto-orienting, so X and Y are
+			// relative to the image as it is displayed
+			croppedImage, err := bimg.NewImage(data).Process(withPayloadOptions(payload, bimg.Options{
+				Top:        payload.Params.CropParams.Y,
+				Left:       payload.Params.CropParams.X,
+				AreaWidth:  payload.Params.CropParams.Width,
+				AreaHeight: payload.Params.CropParams.Height,
+			}))
 
 			if err != nil {
 				return nil, fmt.Errorf("error cropping image: %v", err)
@@ -74,15 +173,14 @@ func imageHandler(db *database.DB, dbTask *database.Task) error {
 		})
 
 	case database.Flip:
-		return doTask(dbTask, db, func() ([]byte, error) {
-			var flippedImage []byte
-			var err error
-			if dbTask.Payload.Params.FlipParams.Axis == "X" {
-				flippedImage, err = bimg.NewImage(data).Flop()
-			} else {
-				flippedImage, err = bimg.NewImage(data).Flip()
+		return doTask(ctx, dbTask, progress, func() ([]byte, error) {
+			o := bimg.Options{Flip: true}
+			if payload.Params.FlipParams.Axis == "X" {
+				o = bimg.Options{Flop: true}
 			}
 
+			flippedImage, err := bimg.NewImage(data).Process(withPayloadOptions(payload, o))
+
 			if err != nil {
 				return nil, fmt.Errorf("error flipping image: %v", err)
 			}
@@ -90,17 +188,45 @@ func imageHandler(db *database.DB, dbTask *database.Task) error {
 			return flippedImage, nil
 		})
 	case database.Rotate:
-		return doTask(dbTask, db, func() ([]byte, error) {
-			rotatedImage, err := bimg.NewImage(data).Rotate(bimg.Angle(dbTask.Payload.Params.RotateParams.Angle))
+		return doTask(ctx, dbTask, progress, func() ([]byte, error) {
+			rotatedImage, err := bimg.NewImage(data).Process(withPayloadOptions(payload, bimg.Options{
+				Rotate: bimg.Angle(payload.Params.RotateParams.Angle),
+			}))
 
 			if err != nil {
-				return nil, fmt.Errorf("error cropping image: %v", err)
+				return nil, fmt.Errorf("error rotating image: %v", err)
 			}
 
 			return rotatedImage, nil
 		})
+	case database.Thumbnails:
+		results, err := generateThumbnails(ctx, data, payload, progress)
+
+		if err != nil {
+			return err
+		}
+
+		progress.Report(ctx, 80, PhaseUploading)
+
+		err = tasks.InsertTaskResults(ctx, dbTask.ID, results)
+
+		if err != nil {
+			return fmt.Errorf("error storing thumbnails: %w", err)
+		}
+
+		return nil
+	case database.Inspect:
+		info, err := inspectImage(data)
+
+		if err != nil {
+			return err
+		}
+
+		dbTask.Result = info
+
+		return nil
 	default:
-		return fmt.Errorf("unimplemented operation: %v", dbTask.Payload.Operation)
+		return fmt.Errorf("unimplemented operation: %v", payload.Operation)
 	}
 
 }
@@ -0,0 +1,112 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/Babatunde50/distributask/internal/database"
+	"github.com/hibiken/asynq"
+)
+
+// MemoryTaskDistributor keeps distributed tasks in memory instead of Redis,
+// so the API and the processor can be run together in-process, such as in
+// tests. Tasks run when Drain is called.
+type MemoryTaskDistributor struct {
+	mu    sync.Mutex
+	tasks []*asynq.Task
+	// ids holds the queue IDs of the outbox messages distributed so far,
+	// which the queue would reject a second time.
+	ids map[string]bool
+}
+
+var _ TaskDistributor = (*MemoryTaskDistributor)(nil)
+
+func NewMemoryTaskDistributor() *MemoryTaskDistributor {
+	return &MemoryTaskDistributor{ids: map[string]bool{}}
+}
+
+func (distributor *MemoryTaskDistributor) DistributeTaskSendTask(ctx context.Context, payload *PayloadSendTask, opts ...asynq.Option) error {
+	return distributor.distribute(TaskSendTask, payload, opts...)
+}
+
+func (distributor *MemoryTaskDistributor) DistributeTaskSendEmail(ctx context.Context, payload *PayloadSendEmail, opts ...asynq.Option) error {
+	return distributor.distribute(TaskSendEmail, payload, opts...)
+}
+
+func (distributor *MemoryTaskDistributor) DistributeOutboxMessage(ctx context.Context, message *database.OutboxMessage) error {
+	distributor.mu.Lock()
+	defer distributor.mu.Unlock()
+
+	if distributor.ids[message.QueueID()] {
+		return nil
+	}
+
+	distributor.ids[message.QueueID()] = true
+	distributor.tasks = append(distributor.tasks, asynq.NewTask(message.Type, message.Payload, asynq.TaskID(message.QueueID())))
+
+	return nil
+}
+
+func (distributor *MemoryTaskDistributor) distribute(typename string, payload any, opts ...asynq.Option) error {
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal task payload: %w", err)
+	}
+
+	distributor.mu.Lock()
+	defer distributor.mu.Unlock()
+
+	distributor.tasks = append(distributor.tasks, asynq.NewTask(typename, jsonPayload, opts...))
+
+	return nil
+}
+
+// Tasks returns the tasks distributed since the last Drain.
+func (distributor *MemoryTaskDistributor) Tasks() []*asynq.Task {
+	distributor.mu.Lock()
+	defer distributor.mu.Unlock()
+
+	return append([]*asynq.Task(nil), distributor.tasks...)
+}
+
+// Drain runs the tasks distributed so far on processor, in the order they
+// were distributed, until none are left. Failures go to the processor's
+// error handler like they would from the queue, but aren't retried. Drain
+// returns the first failure.
+func (distributor *MemoryTaskDistributor) Drain(ctx context.Context, processor TaskProcessor) error {
+	var firstErr error
+
+	for {
+		distributor.mu.Lock()
+		tasks := distributor.tasks
+		distributor.tasks = nil
+		distributor.mu.Unlock()
+
+		if len(tasks) == 0 {
+			return firstErr
+		}
+
+		for _, task := range tasks {
+			var err error
+
+			switch task.Type() {
+			case TaskSendTask:
+				err = processor.ProcessTaskSendTask(ctx, task)
+			case TaskSendEmail:
+				err = processor.ProcessTaskSendEmail(ctx, task)
+			default:
+				err = fmt.Errorf("unknown task type %q", task.Type())
+			}
+
+			if err != nil {
+				processor.HandleError(ctx, task, err)
+
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+}
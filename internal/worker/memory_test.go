@@ -0,0 +1,96 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Babatunde50/distributask/internal/database"
+	"github.com/Babatunde50/distributask/internal/database/memory"
+	"github.com/Babatunde50/distributask/internal/fetcher"
+	"github.com/hibiken/asynq"
+)
+
+func TestDrainRecordsFailures(t *testing.T) {
+	ctx := context.Background()
+	store := memory.New()
+
+	userID, err := store.InsertUser(ctx, "alice@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the fetcher refuses loopback addresses, which is a permanent failure
+	task := &database.Task{
+		UserId: userID,
+		Type:   "image_processing",
+		Payload: database.Payload{
+			URL:       "http://127.0.0.1/image.png",
+			Operation: database.Resize,
+			Params:    database.TransformParams{ResizeParams: database.ResizeParams{Width: 10, Height: 10}},
+		},
+		MaxRetries: 3,
+	}
+
+	err = store.InsertTask(ctx, task, database.TaskQuota{}, NewSendTaskMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	distributor := NewMemoryTaskDistributor()
+
+	for _, message := range store.OutboxMessages() {
+		err = distributor.DistributeOutboxMessage(ctx, message)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	processor := &RedisTaskProcessor{
+		baseProcessor: newBaseProcessor(store, nil, fetcher.New(fetcher.Config{MaxBytes: 1 << 20}), nil),
+	}
+
+	err = distributor.Drain(ctx, processor)
+	if !errors.Is(err, asynq.SkipRetry) {
+		t.Fatalf("Drain returned %v, want a permanent failure", err)
+	}
+
+	if tasks := distributor.Tasks(); len(tasks) != 0 {
+		t.Errorf("%d tasks left after Drain", len(tasks))
+	}
+
+	got, err := store.GetTaskByID(ctx, task.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Status != database.TaskStatusFailed {
+		t.Errorf("task status is %q, want %q", got.Status, database.TaskStatusFailed)
+	}
+
+	events, err := store.ListTaskEvents(ctx, task.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+
+	want := []string{database.TaskEventQueued, database.TaskEventStarted, database.TaskEventFailed}
+
+	if len(types) != len(want) {
+		t.Fatalf("task events are %v, want %v", types, want)
+	}
+
+	for i := range want {
+		if types[i] != want[i] {
+			t.Fatalf("task events are %v, want %v", types, want)
+		}
+	}
+
+	if events[2].Details == "" {
+		t.Error("failed event doesn't say why")
+	}
+}
@@ -0,0 +1,164 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Babatunde50/distributask/internal/database"
+)
+
+const (
+	// outboxLease is how long a claimed message is hidden from other relays
+	// while it is being published.
+	outboxLease = 30 * time.Second
+
+	outboxMaxBackoff = 5 * time.Minute
+)
+
+// OutboxRelayConfig configures an OutboxRelay.
+type OutboxRelayConfig struct {
+	// PollInterval is how often the outbox is checked for unsent messages.
+	PollInterval time.Duration
+	// BatchSize is how many messages are claimed at once.
+	BatchSize int
+	// Retention is how long sent messages are kept, zero to keep them.
+	Retention time.Duration
+}
+
+// OutboxRelay publishes the messages written to the outbox to the task
+// queue. Every message is published at least once: one that was enqueued but
+// couldn't be marked sent is published again, which the queue deduplicates by
+// the message's key. Any number of relays may run at once.
+type OutboxRelay struct {
+	outbox      database.OutboxStore
+	distributor TaskDistributor
+	config      OutboxRelayConfig
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewOutboxRelay(outbox database.OutboxStore, distributor TaskDistributor, config OutboxRelayConfig) *OutboxRelay {
+	return &OutboxRelay{outbox: outbox, distributor: distributor, config: config}
+}
+
+// Start relays messages in the background until Shutdown is called.
+func (relay *OutboxRelay) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	relay.cancel = cancel
+
+	relay.wg.Add(1)
+
+	go func() {
+		defer relay.wg.Done()
+
+		ticker := time.NewTicker(relay.config.PollInterval)
+		defer ticker.Stop()
+
+		lastCleanup := time.Now()
+
+		for {
+			// keep going while there's a backlog instead of waiting a tick
+			// per batch
+			for {
+				claimed := relay.relay(ctx)
+				if claimed < relay.config.BatchSize || ctx.Err() != nil {
+					break
+				}
+			}
+
+			if relay.config.Retention > 0 && time.Since(lastCleanup) > time.Hour {
+				relay.cleanup(ctx)
+				lastCleanup = time.Now()
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Shutdown stops relaying and waits for the batch being published.
+func (relay *OutboxRelay) Shutdown() {
+	if relay.cancel != nil {
+		relay.cancel()
+	}
+
+	relay.wg.Wait()
+}
+
+// relay publishes a batch of messages and returns how many it claimed.
+func (relay *OutboxRelay) relay(ctx context.Context) int {
+	messages, err := relay.outbox.ClaimOutboxMessages(ctx, relay.config.BatchSize, outboxLease)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Failed to claim outbox messages: %v", err)
+		}
+		return 0
+	}
+
+	sent := make([]int64, 0, len(messages))
+
+	for _, message := range messages {
+		enqueueCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		err := relay.distributor.DistributeOutboxMessage(enqueueCtx, message)
+		cancel()
+
+		if err != nil {
+			log.Printf("Failed to relay outbox message %d: %v", message.ID, err)
+
+			// the message stays claimed until the retry, failing to record
+			// the error only means it is retried after the lease instead
+			err = relay.outbox.MarkOutboxMessageFailed(context.Background(), message.ID, err.Error(), time.Now().Add(outboxBackoff(message.Attempts)))
+			if err != nil {
+				log.Printf("Failed to record failure of outbox message %d: %v", message.ID, err)
+			}
+			continue
+		}
+
+		sent = append(sent, message.ID)
+	}
+
+	if len(sent) > 0 {
+		// the batch is published, so this mustn't be cut short by a shutdown
+		err = relay.outbox.MarkOutboxMessagesSent(context.Background(), sent)
+		if err != nil {
+			// they are relayed again after the lease, and deduplicated
+			log.Printf("Failed to mark %d outbox messages sent: %v", len(sent), err)
+		}
+	}
+
+	return len(messages)
+}
+
+func (relay *OutboxRelay) cleanup(ctx context.Context) {
+	deleted, err := relay.outbox.DeleteSentOutboxMessages(ctx, time.Now().Add(-relay.config.Retention))
+	if err != nil {
+		log.Printf("Failed to delete sent outbox messages: %v", err)
+		return
+	}
+
+	if deleted > 0 {
+		log.Printf("Deleted %d sent outbox messages", deleted)
+	}
+}
+
+// outboxBackoff doubles the delay before retrying a message with every
+// attempt, up to outboxMaxBackoff.
+func outboxBackoff(attempts int) time.Duration {
+	if attempts > 9 {
+		return outboxMaxBackoff
+	}
+
+	backoff := time.Second << attempts
+	if backoff > outboxMaxBackoff {
+		return outboxMaxBackoff
+	}
+
+	return backoff
+}
@@ -0,0 +1,496 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Babatunde50/distributask/internal/database"
+	"github.com/Babatunde50/distributask/internal/fetcher"
+	"github.com/Babatunde50/distributask/internal/mailer"
+	"github.com/Babatunde50/distributask/internal/storage"
+	"github.com/hibiken/asynq"
+	"github.com/lib/pq"
+)
+
+const (
+	// postgresMaxRetry and postgresTimeout default like asynq's do.
+	postgresMaxRetry = 25
+	postgresTimeout  = 30 * time.Minute
+	// postgresShutdownTimeout is how long Shutdown waits for running tasks
+	// before cancelling them, like asynq's default.
+	postgresShutdownTimeout = 8 * time.Second
+)
+
+// postgresQueues are the queues the Postgres processor serves, the first
+// one being drained before the next, like the Redis processor's strict
+// priority.
+var postgresQueues = []string{QueueCritical, QueueDefault, QueueLow}
+
+// PostgresQueueConfig configures the Postgres queue.
+type PostgresQueueConfig struct {
+	// Concurrency is how many tasks a processor runs at once.
+	Concurrency int
+	// PollInterval is how often idle workers look for due tasks they
+	// weren't notified of, such as retries.
+	PollInterval time.Duration
+	// Lease is how long a task is hidden from other workers unless its
+	// worker extends it, so it is how soon the tasks of a crashed worker
+	// run again.
+	Lease time.Duration
+	// ArchiveRetention is how long tasks that ran out of retries are kept,
+	// zero to keep them.
+	ArchiveRetention time.Duration
+}
+
+// PostgresTaskDistributor enqueues tasks into the Postgres queue.
+type PostgresTaskDistributor struct {
+	db *database.DB
+}
+
+func NewPostgresTaskDistributor(db *database.DB) TaskDistributor {
+	return &PostgresTaskDistributor{db: db}
+}
+
+func (distributor *PostgresTaskDistributor) DistributeTaskSendTask(ctx context.Context, payload *PayloadSendTask, opts ...asynq.Option) error {
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal task payload: %w", err)
+	}
+
+	err = distributor.enqueue(ctx, &database.QueueJob{Type: TaskSendTask, Payload: jsonPayload, Group: userGroup(payload.UserID)}, opts)
+	if err != nil {
+		return fmt.Errorf("failed to enqueue task: %w", err)
+	}
+
+	return nil
+}
+
+func (distributor *PostgresTaskDistributor) DistributeTaskSendEmail(ctx context.Context, payload *PayloadSendEmail, opts ...asynq.Option) error {
+	jsonPayload, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal email payload: %w", err)
+	}
+
+	err = distributor.enqueue(ctx, &database.QueueJob{Type: TaskSendEmail, Payload: jsonPayload}, opts)
+	if err != nil {
+		return fmt.Errorf("failed to enqueue email: %w", err)
+	}
+
+	return nil
+}
+
+// DistributeOutboxMessage enqueues a message relayed from the outbox, such
+// as one written before switching to the Postgres queue, under its queue ID.
+func (distributor *PostgresTaskDistributor) DistributeOutboxMessage(ctx context.Context, message *database.OutboxMessage) error {
+	_, err := distributor.db.EnqueueJob(ctx, &database.QueueJob{
+		Key:      message.QueueID(),
+		Type:     message.Type,
+		Payload:  message.Payload,
+		Queue:    message.Queue,
+		Group:    message.Group,
+		MaxRetry: message.MaxRetry,
+		Timeout:  message.Timeout,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enqueue outbox message: %w", err)
+	}
+
+	return nil
+}
+
+// enqueue enqueues job with the asynq options the Postgres queue supports:
+// the queue, retries, timeout, task ID and when to process it. Other options
+// are ignored.
+func (distributor *PostgresTaskDistributor) enqueue(ctx context.Context, job *database.QueueJob, opts []asynq.Option) error {
+	job.Queue = QueueDefault
+	job.MaxRetry = postgresMaxRetry
+
+	for _, opt := range opts {
+		switch opt.Type() {
+		case asynq.QueueOpt:
+			job.Queue = opt.Value().(string)
+		case asynq.MaxRetryOpt:
+			job.MaxRetry = opt.Value().(int)
+		case asynq.TimeoutOpt:
+			job.Timeout = int(opt.Value().(time.Duration).Seconds())
+		case asynq.TaskIDOpt:
+			job.Key = opt.Value().(string)
+		case asynq.ProcessAtOpt:
+			job.RunAt = opt.Value().(time.Time)
+		case asynq.ProcessInOpt:
+			job.RunAt = time.Now().Add(opt.Value().(time.Duration))
+		}
+	}
+
+	inserted, err := distributor.db.EnqueueJob(ctx, job)
+	if err != nil {
+		return err
+	}
+
+	if !inserted {
+		return asynq.ErrTaskIDConflict
+	}
+
+	return nil
+}
+
+// PostgresTaskProcessor processes the tasks of the Postgres queue. Workers
+// claim tasks with SELECT ... FOR UPDATE SKIP LOCKED and keep extending
+// their lease while processing them. They are woken up by LISTEN/NOTIFY as
+// soon as a task is enqueued and otherwise poll for due tasks.
+type PostgresTaskProcessor struct {
+	*baseProcessor
+	db              *database.DB
+	config          PostgresQueueConfig
+	maxTasksPerUser int
+	mux             *asynq.ServeMux
+
+	mu   sync.Mutex
+	wake chan struct{}
+	// leased holds the IDs of the jobs being processed, whose leases the
+	// heartbeat extends.
+	leased map[int64]bool
+
+	stop      context.CancelFunc
+	abort     context.CancelFunc
+	heartbeat context.CancelFunc
+	workers   sync.WaitGroup
+	wg        sync.WaitGroup
+}
+
+// NewPostgresTaskProcessor creates a processor that runs at most
+// maxTasksPerUser tasks of the same user at once, across all workers, like
+// NewRedisTaskProcessor. Zero disables the cap.
+func NewPostgresTaskProcessor(db *database.DB, config PostgresQueueConfig, store storage.Storage, fetch *fetcher.Fetcher, mail mailer.Mailer, maxTasksPerUser int) TaskProcessor {
+	processor := &PostgresTaskProcessor{
+		baseProcessor:   newBaseProcessor(db, store, fetch, mail),
+		db:              db,
+		config:          config,
+		maxTasksPerUser: maxTasksPerUser,
+		mux:             asynq.NewServeMux(),
+		wake:            make(chan struct{}),
+		leased:          map[int64]bool{},
+	}
+
+	processor.mux.Handle(TaskSendTask, loggingMiddleware(asynq.HandlerFunc(processor.ProcessTaskSendTask)))
+	processor.mux.Handle(TaskSendEmail, loggingMiddleware(asynq.HandlerFunc(processor.ProcessTaskSendEmail)))
+
+	return processor
+}
+
+func (processor *PostgresTaskProcessor) Start() error {
+	listener, err := processor.db.QueueListener()
+	if err != nil {
+		return fmt.Errorf("failed to listen for queued tasks: %w", err)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	runCtx, abort := context.WithCancel(context.Background())
+	heartbeatCtx, heartbeat := context.WithCancel(context.Background())
+
+	processor.stop = stop
+	processor.abort = abort
+	processor.heartbeat = heartbeat
+
+	processor.wg.Add(2)
+
+	go func() {
+		defer processor.wg.Done()
+		defer listener.Close()
+
+		processor.listen(ctx, listener)
+	}()
+
+	go func() {
+		defer processor.wg.Done()
+
+		processor.extendLeases(heartbeatCtx)
+	}()
+
+	for i := 0; i < processor.config.Concurrency; i++ {
+		processor.workers.Add(1)
+
+		go func() {
+			defer processor.workers.Done()
+
+			processor.work(ctx, runCtx)
+		}()
+	}
+
+	return nil
+}
+
+// Shutdown stops claiming new tasks and cancels the context of the tasks
+// still running once the shutdown timeout elapses. Those run again once
+// their lease runs out.
+func (processor *PostgresTaskProcessor) Shutdown() {
+	if processor.stop == nil {
+		return
+	}
+
+	processor.stop()
+
+	done := make(chan struct{})
+
+	go func() {
+		processor.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(postgresShutdownTimeout):
+		processor.abort()
+		<-done
+	}
+
+	processor.abort()
+	processor.heartbeat()
+	processor.wg.Wait()
+}
+
+// listen wakes the idle workers up whenever a task is enqueued.
+func (processor *PostgresTaskProcessor) listen(ctx context.Context, listener *pq.Listener) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-listener.Notify:
+			// a nil notification means the connection was reestablished,
+			// and tasks enqueued in the meantime were missed, so waking up
+			// is right either way
+			processor.wakeAll()
+		}
+	}
+}
+
+// wakeup returns a channel that is closed when the workers are woken up.
+func (processor *PostgresTaskProcessor) wakeup() <-chan struct{} {
+	processor.mu.Lock()
+	defer processor.mu.Unlock()
+
+	return processor.wake
+}
+
+func (processor *PostgresTaskProcessor) wakeAll() {
+	processor.mu.Lock()
+	defer processor.mu.Unlock()
+
+	close(processor.wake)
+	processor.wake = make(chan struct{})
+}
+
+// work claims and processes tasks until ctx is done. Tasks run with runCtx,
+// which outlives ctx to let them finish on shutdown.
+func (processor *PostgresTaskProcessor) work(ctx, runCtx context.Context) {
+	for {
+		// taken before claiming, so a task enqueued while claiming isn't
+		// left waiting for the next poll
+		wake := processor.wakeup()
+
+		job, err := processor.db.ClaimJob(ctx, postgresQueues, processor.name, processor.config.Lease, processor.maxTasksPerUser)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Failed to claim task: %v", err)
+		}
+
+		if job != nil {
+			processor.process(runCtx, job)
+			continue
+		}
+
+		timer := time.NewTimer(processor.config.PollInterval)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-wake:
+		case <-timer.C:
+		}
+
+		timer.Stop()
+	}
+}
+
+func (processor *PostgresTaskProcessor) process(ctx context.Context, job *database.QueueJob) {
+	processor.setLeased(job.ID, true)
+	defer processor.setLeased(job.ID, false)
+
+	timeout := postgresTimeout
+	if job.Timeout > 0 {
+		timeout = time.Duration(job.Timeout) * time.Second
+	}
+
+	taskCtx, cancel := context.WithTimeout(withRetryCount(ctx, job.Retried, job.MaxRetry), timeout)
+	defer cancel()
+
+	task := asynq.NewTask(job.Type, job.Payload)
+	taskErr := processor.run(taskCtx, task)
+
+	if ctx.Err() != nil {
+		log.Printf("Task %d was cancelled by the shutdown, it runs again once its lease runs out", job.ID)
+		return
+	}
+
+	// the task's own context may be done by now, the job is updated with a
+	// fresh one
+	dbCtx, dbCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer dbCancel()
+
+	var err error
+
+	switch {
+	case taskErr == nil:
+		err = processor.db.CompleteJob(dbCtx, job.ID, processor.name)
+	case job.Retried >= job.MaxRetry || errors.Is(taskErr, asynq.SkipRetry):
+		processor.HandleError(taskCtx, task, taskErr)
+		err = processor.db.ArchiveJob(dbCtx, job.ID, processor.name, taskErr.Error())
+	default:
+		processor.HandleError(taskCtx, task, taskErr)
+		err = processor.db.RetryJob(dbCtx, job.ID, processor.name, taskErr.Error(), retryDelay)
+	}
+
+	if err != nil {
+		log.Printf("Failed to update task %d in the queue: %v", job.ID, err)
+	}
+}
+
+// run processes task, turning a panic into an error like asynq does.
+func (processor *PostgresTaskProcessor) run(ctx context.Context, task *asynq.Task) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return processor.mux.ProcessTask(ctx, task)
+}
+
+func (processor *PostgresTaskProcessor) setLeased(id int64, leased bool) {
+	processor.mu.Lock()
+	defer processor.mu.Unlock()
+
+	if leased {
+		processor.leased[id] = true
+	} else {
+		delete(processor.leased, id)
+	}
+}
+
+// extendLeases extends the leases of the tasks being processed a few times
+// per lease, and puts the tasks whose lease ran out back into the queue.
+func (processor *PostgresTaskProcessor) extendLeases(ctx context.Context) {
+	ticker := time.NewTicker(processor.config.Lease / 3)
+	defer ticker.Stop()
+
+	lastCleanup := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		processor.mu.Lock()
+		ids := make([]int64, 0, len(processor.leased))
+		for id := range processor.leased {
+			ids = append(ids, id)
+		}
+		processor.mu.Unlock()
+
+		if len(ids) > 0 {
+			err := processor.db.ExtendJobLeases(ctx, processor.name, ids, processor.config.Lease)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Failed to extend the leases of %d tasks: %v", len(ids), err)
+			}
+		}
+
+		recovered, err := processor.db.RecoverExpiredJobs(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Failed to recover tasks with expired leases: %v", err)
+		}
+
+		if recovered > 0 {
+			log.Printf("Recovered %d tasks whose lease ran out", recovered)
+			processor.wakeAll()
+		}
+
+		if processor.config.ArchiveRetention > 0 && time.Since(lastCleanup) > time.Hour {
+			processor.cleanup(ctx)
+			lastCleanup = time.Now()
+		}
+	}
+}
+
+func (processor *PostgresTaskProcessor) cleanup(ctx context.Context) {
+	deleted, err := processor.db.DeleteArchivedJobs(ctx, time.Now().Add(-processor.config.ArchiveRetention))
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Failed to delete archived tasks: %v", err)
+		}
+		return
+	}
+
+	if deleted > 0 {
+		log.Printf("Deleted %d archived tasks", deleted)
+	}
+}
+
+// PostgresInspector tells the reconciler what the Postgres queue knows about
+// a task, in asynq's terms.
+type PostgresInspector struct {
+	db *database.DB
+}
+
+func NewPostgresInspector(db *database.DB) *PostgresInspector {
+	return &PostgresInspector{db: db}
+}
+
+func (inspector *PostgresInspector) GetTaskInfo(queue, id string) (*asynq.TaskInfo, error) {
+	job, err := inspector.db.GetJob(context.Background(), queue, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if job == nil {
+		return nil, asynq.ErrTaskNotFound
+	}
+
+	info := &asynq.TaskInfo{
+		ID:            job.Key,
+		Queue:         job.Queue,
+		Type:          job.Type,
+		Payload:       job.Payload,
+		MaxRetry:      job.MaxRetry,
+		Retried:       job.Retried,
+		LastErr:       job.LastError,
+		Timeout:       time.Duration(job.Timeout) * time.Second,
+		NextProcessAt: job.RunAt,
+	}
+
+	switch {
+	case job.State == database.JobStateActive:
+		info.State = asynq.TaskStateActive
+	case job.State == database.JobStateArchived:
+		info.State = asynq.TaskStateArchived
+	case job.RunAt.After(time.Now()) && job.Retried > 0:
+		info.State = asynq.TaskStateRetry
+	case job.RunAt.After(time.Now()):
+		info.State = asynq.TaskStateScheduled
+	default:
+		info.State = asynq.TaskStatePending
+	}
+
+	return info, nil
+}
+
+// Close is a no-op, the database is closed by its owner.
+func (inspector *PostgresInspector) Close() error {
+	return nil
+}
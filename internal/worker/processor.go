@@ -3,11 +3,17 @@ package worker
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"log"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/Babatunde50/distributask/internal/database"
+	"github.com/Babatunde50/distributask/internal/fetcher"
+	"github.com/Babatunde50/distributask/internal/mailer"
+	"github.com/Babatunde50/distributask/internal/storage"
+	"github.com/go-redis/redis/v8"
 	"github.com/hibiken/asynq"
 )
 
@@ -17,19 +23,56 @@ const (
 	QueueLow      = "low"
 )
 
+// retryDelay is how long a failed task waits before it is retried.
+const retryDelay = 20 * time.Second
+
 type TaskProcessor interface {
 	Start() error
+	Shutdown()
 	ProcessTaskSendTask(ctx context.Context, task *asynq.Task) error
+	ProcessTaskSendEmail(ctx context.Context, task *asynq.Task) error
+	HandleError(ctx context.Context, task *asynq.Task, taskErr error)
+}
+
+// baseProcessor processes tasks, whichever queue they come from.
+type baseProcessor struct {
+	tasks   database.TaskStore
+	storage storage.Storage
+	fetcher *fetcher.Fetcher
+	mailer  mailer.Mailer
+	// name identifies this worker in the history of the tasks it runs.
+	name string
+}
+
+func newBaseProcessor(tasks database.TaskStore, store storage.Storage, fetch *fetcher.Fetcher, mail mailer.Mailer) *baseProcessor {
+	return &baseProcessor{
+		tasks:   tasks,
+		storage: store,
+		fetcher: fetch,
+		mailer:  mail,
+		name:    workerName(),
+	}
 }
 
 type RedisTaskProcessor struct {
-	server *asynq.Server
-	db     *database.DB
+	*baseProcessor
+	server   *asynq.Server
+	inFlight *inFlightLimiter
 }
 
-func NewRedisTaskProcessor(redisOpt asynq.RedisClientOpt, db *database.DB) TaskProcessor {
+// NewRedisTaskProcessor creates a processor that runs at most
+// maxTasksPerUser tasks of the same user at once, across all workers, so a
+// single user's backlog can't starve everybody else. Zero disables the cap.
+func NewRedisTaskProcessor(redisOpt asynq.RedisClientOpt, tasks database.TaskStore, store storage.Storage, fetch *fetcher.Fetcher, mail mailer.Mailer, maxTasksPerUser int) TaskProcessor {
+	processor := &RedisTaskProcessor{
+		baseProcessor: newBaseProcessor(tasks, store, fetch, mail),
+		inFlight: &inFlightLimiter{
+			client:   redisOpt.MakeRedisClient().(redis.UniversalClient),
+			maxTasks: maxTasksPerUser,
+		},
+	}
 
-	server := asynq.NewServer(
+	processor.server = asynq.NewServer(
 		redisOpt,
 		asynq.Config{
 			Queues: map[string]int{
@@ -38,35 +81,65 @@ func NewRedisTaskProcessor(redisOpt asynq.RedisClientOpt, db *database.DB) TaskP
 				QueueLow:      1,
 			},
 			StrictPriority: true,
-			ErrorHandler: asynq.ErrorHandlerFunc(func(ctx context.Context, task *asynq.Task, err error) {
-				fmt.Println("Process task failed...", err)
-				// update task status to failed...
-				var payload PayloadSendTask
-				if err := json.Unmarshal(task.Payload(), &payload); err != nil {
-					return
+			IsFailure: func(err error) bool {
+				return !errors.Is(err, errUserAtCapacity)
+			},
+			ErrorHandler: asynq.ErrorHandlerFunc(processor.HandleError),
+			RetryDelayFunc: func(n int, e error, task *asynq.Task) time.Duration {
+				if errors.Is(e, errUserAtCapacity) {
+					return deferDelay()
 				}
+				return retryDelay
+			},
+		},
+	)
 
-				gottenTask, err := db.GetTask(payload.TaskID, payload.UserID)
+	return processor
+}
 
-				if err != nil {
-					return
-				}
+// HandleError records the failure of a task, as failed or timed out if it
+// won't be retried and as queued again if it will.
+func (processor *baseProcessor) HandleError(ctx context.Context, task *asynq.Task, taskErr error) {
+	if task.Type() != TaskSendTask || errors.Is(taskErr, errUserAtCapacity) {
+		return
+	}
 
-				gottenTask.Status = "failed"
+	var payload PayloadSendTask
+	if err := json.Unmarshal(task.Payload(), &payload); err != nil {
+		return
+	}
 
-				gottenTask.RetryCount += 1
+	log.Printf("Processing task %d failed: %v", payload.TaskID, taskErr)
 
-				db.UpdateTask(gottenTask)
-			}),
-			RetryDelayFunc: func(n int, e error, task *asynq.Task) time.Duration {
-				return time.Duration(time.Duration.Seconds(20))
-			},
-		},
-	)
+	// the task's own context is usually done by now, often being
+	// the reason it failed, so the status update gets a fresh one
+	dbCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	return &RedisTaskProcessor{
-		server: server,
-		db:     db,
+	gottenTask, err := processor.tasks.GetTask(dbCtx, payload.TaskID, payload.UserID)
+
+	if err != nil {
+		return
+	}
+
+	status := database.TaskStatusFailed
+
+	if errors.Is(taskErr, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		status = database.TaskStatusTimedOut
+	}
+
+	retried, maxRetry := retryCount(ctx)
+
+	if retried < maxRetry && !errors.Is(taskErr, asynq.SkipRetry) {
+		status = database.TaskStatusQueued
+	}
+
+	// a later attempt may have completed the task in the meantime,
+	// which this mustn't overwrite
+	err = processor.tasks.MarkFailed(dbCtx, gottenTask, database.TaskAttempt{Worker: processor.name, Attempt: retried}, status, taskErr.Error())
+
+	if err != nil {
+		log.Printf("Failed to record failure of task %d: %v", gottenTask.ID, err)
 	}
 }
 
@@ -75,11 +148,54 @@ func (processor *RedisTaskProcessor) Start() error {
 
 	// mux.HandleFunc(TaskSendTask, processor.ProcessTaskSendTask)
 
-	mux.Handle(TaskSendTask, loggingMiddleware(asynq.HandlerFunc(processor.ProcessTaskSendTask)))
+	mux.Handle(TaskSendTask, loggingMiddleware(processor.inFlight.middleware(asynq.HandlerFunc(processor.ProcessTaskSendTask))))
+	mux.Handle(TaskSendEmail, loggingMiddleware(asynq.HandlerFunc(processor.ProcessTaskSendEmail)))
 
 	return processor.server.Start(mux)
 }
 
+// Shutdown stops pulling new tasks and cancels the context of the tasks still
+// running once the shutdown timeout elapses.
+func (processor *RedisTaskProcessor) Shutdown() {
+	processor.server.Shutdown()
+}
+
+type retryCountKey struct{}
+
+type retryCounts struct {
+	retried, maxRetry int
+}
+
+// withRetryCount stores how often the task was retried, and may be at most,
+// in ctx for queues other than asynq's, which stores them itself.
+func withRetryCount(ctx context.Context, retried, maxRetry int) context.Context {
+	return context.WithValue(ctx, retryCountKey{}, retryCounts{retried, maxRetry})
+}
+
+// retryCount returns how often the task processed with ctx was retried so
+// far and how often it may be retried at most.
+func retryCount(ctx context.Context) (retried, maxRetry int) {
+	if counts, ok := ctx.Value(retryCountKey{}).(retryCounts); ok {
+		return counts.retried, counts.maxRetry
+	}
+
+	retried, _ = asynq.GetRetryCount(ctx)
+	maxRetry, _ = asynq.GetMaxRetry(ctx)
+
+	return retried, maxRetry
+}
+
+// workerName identifies the process, which may share its host with other
+// workers.
+func workerName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	return host + ":" + strconv.Itoa(os.Getpid())
+}
+
 // middleware...
 func loggingMiddleware(h asynq.Handler) asynq.Handler {
 	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
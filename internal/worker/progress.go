@@ -0,0 +1,70 @@
+package worker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Babatunde50/distributask/internal/database"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	PhaseDownloading  = "downloading"
+	PhaseTransforming = "transforming"
+	PhaseUploading    = "uploading"
+	PhaseCompleted    = "completed"
+)
+
+// progressInterval is the minimum time between two progress writes for the
+// same phase, so tight loops don't turn into a stream of UPDATE statements.
+const progressInterval = time.Second
+
+// progressReporter persists the progress of a running task. Reports are
+// throttled: a write only happens when the phase changes, the task reaches
+// 100% or progressInterval has passed since the last write.
+type progressReporter struct {
+	tasks  database.TaskStore
+	taskID int
+
+	mu        sync.Mutex
+	last      database.TaskProgress
+	lastWrite time.Time
+}
+
+func newProgressReporter(tasks database.TaskStore, taskID int) *progressReporter {
+	return &progressReporter{tasks: tasks, taskID: taskID}
+}
+
+// Report records percent (clamped to 0-100) for phase. Failing to store
+// progress never fails the task itself.
+func (p *progressReporter) Report(ctx context.Context, percent int, phase string) {
+	if percent < 0 {
+		percent = 0
+	}
+	if percent > 100 {
+		percent = 100
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	progress := database.TaskProgress{Percent: percent, Phase: phase}
+
+	if progress == p.last {
+		return
+	}
+
+	if phase == p.last.Phase && percent < 100 && time.Since(p.lastWrite) < progressInterval {
+		return
+	}
+
+	err := p.tasks.UpdateTaskProgress(ctx, p.taskID, progress)
+	if err != nil {
+		log.Warn().Err(err).Int("task_id", p.taskID).Msg("failed to store task progress")
+		return
+	}
+
+	p.last = progress
+	p.lastWrite = time.Now()
+}
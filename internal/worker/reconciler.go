@@ -0,0 +1,217 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Babatunde50/distributask/internal/database"
+	"github.com/hibiken/asynq"
+)
+
+// reconcilerMetrics are the running totals of every reconciliation, published
+// with the other expvar metrics.
+var reconcilerMetrics = expvar.NewMap("reconciler")
+
+// ReconcilerConfig configures a Reconciler.
+type ReconcilerConfig struct {
+	// Interval is how often tasks are reconciled.
+	Interval time.Duration
+	// Grace is how long a task may look stuck before it is acted on, to
+	// leave the outbox relay and the queue time to catch up.
+	Grace time.Duration
+	// BatchSize is how many stuck tasks are reconciled at once.
+	BatchSize int
+}
+
+// ReconcileStats counts what a reconciliation found and did.
+type ReconcileStats struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	// Checked is how many tasks looked stuck, Healthy how many of those the
+	// queue still had in hand.
+	Checked  int `json:"checked"`
+	Healthy  int `json:"healthy"`
+	Requeued int `json:"requeued"`
+	Failed   int `json:"failed"`
+	Errors   int `json:"errors"`
+}
+
+// QueueInspector tells what the queue knows about a task. asynq's Inspector
+// is one, PostgresInspector the one of the Postgres queue.
+type QueueInspector interface {
+	GetTaskInfo(queue, id string) (*asynq.TaskInfo, error)
+	Close() error
+}
+
+// Reconciler compares tasks that look stuck with what the queue knows about
+// them. Tasks queued in the database but lost by the queue are queued again,
+// and tasks in progress whose timeout ran out while the queue no longer holds
+// them, because their worker crashed, are marked timed out.
+type Reconciler struct {
+	db        *database.DB
+	inspector QueueInspector
+	config    ReconcilerConfig
+
+	mu   sync.Mutex
+	last *ReconcileStats
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewReconciler(inspector QueueInspector, db *database.DB, config ReconcilerConfig) *Reconciler {
+	return &Reconciler{
+		db:        db,
+		inspector: inspector,
+		config:    config,
+	}
+}
+
+// Start reconciles tasks every interval in the background until Shutdown is
+// called.
+func (reconciler *Reconciler) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	reconciler.cancel = cancel
+
+	reconciler.wg.Add(1)
+
+	go func() {
+		defer reconciler.wg.Done()
+
+		ticker := time.NewTicker(reconciler.config.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				stats := reconciler.Reconcile(ctx)
+
+				if stats.Requeued > 0 || stats.Failed > 0 || stats.Errors > 0 {
+					log.Printf("Reconciled %d stuck tasks: %d requeued, %d failed, %d errors", stats.Checked, stats.Requeued, stats.Failed, stats.Errors)
+				}
+			}
+		}
+	}()
+}
+
+// Shutdown stops reconciling and waits for the reconciliation under way.
+func (reconciler *Reconciler) Shutdown() {
+	if reconciler.cancel != nil {
+		reconciler.cancel()
+	}
+
+	reconciler.wg.Wait()
+	reconciler.inspector.Close()
+}
+
+// LastRun returns the stats of the last reconciliation, or nil if there
+// hasn't been one yet.
+func (reconciler *Reconciler) LastRun() *ReconcileStats {
+	reconciler.mu.Lock()
+	defer reconciler.mu.Unlock()
+
+	return reconciler.last
+}
+
+// Reconcile reconciles one batch of stuck tasks.
+func (reconciler *Reconciler) Reconcile(ctx context.Context) ReconcileStats {
+	stats := ReconcileStats{StartedAt: time.Now()}
+
+	tasks, err := reconciler.db.ListStuckTasks(ctx, stats.StartedAt.Add(-reconciler.config.Grace), reconciler.config.BatchSize)
+	if err != nil {
+		log.Printf("Failed to list stuck tasks: %v", err)
+		stats.Errors++
+	}
+
+	for _, task := range tasks {
+		stats.Checked++
+
+		err := reconciler.reconcileTask(ctx, task, &stats)
+		if err != nil {
+			log.Printf("Failed to reconcile task %d: %v", task.ID, err)
+			stats.Errors++
+		}
+	}
+
+	stats.FinishedAt = time.Now()
+
+	reconcilerMetrics.Add("runs", 1)
+	reconcilerMetrics.Add("checked", int64(stats.Checked))
+	reconcilerMetrics.Add("healthy", int64(stats.Healthy))
+	reconcilerMetrics.Add("requeued", int64(stats.Requeued))
+	reconcilerMetrics.Add("failed", int64(stats.Failed))
+	reconcilerMetrics.Add("errors", int64(stats.Errors))
+
+	reconciler.mu.Lock()
+	reconciler.last = &stats
+	reconciler.mu.Unlock()
+
+	return stats
+}
+
+func (reconciler *Reconciler) reconcileTask(ctx context.Context, task *database.StuckTask, stats *ReconcileStats) error {
+	// a missing task is zero, which isn't any of the states
+	var state asynq.TaskState
+
+	info, err := reconciler.inspector.GetTaskInfo(QueueForPriority(task.Priority), database.TaskMessageKey(task.ID))
+
+	switch {
+	case errors.Is(err, asynq.ErrTaskNotFound), errors.Is(err, asynq.ErrQueueNotFound):
+	case err != nil:
+		return err
+	default:
+		state = info.State
+	}
+
+	var changed bool
+
+	switch {
+	case task.Status == database.TaskStatusQueued && state == 0:
+		message, err := NewSendTaskMessage(&database.Task{ID: task.ID, UserId: task.UserId, Priority: task.Priority, Timeout: task.Timeout, MaxRetries: task.MaxRetries})
+		if err != nil {
+			return err
+		}
+
+		changed, err = reconciler.db.RequeueTask(ctx, task.ID, message, "requeued by the reconciler, the queue lost the task")
+		if err != nil {
+			return err
+		}
+
+		if changed {
+			stats.Requeued++
+		}
+	case task.Status == database.TaskStatusQueued && state == asynq.TaskStateArchived:
+		changed, err = reconciler.db.FailStuckTask(ctx, task.ID, task.Status, database.TaskStatusFailed, "failed by the reconciler, the queue gave up on the task: "+info.LastErr)
+		if err != nil {
+			return err
+		}
+
+		if changed {
+			stats.Failed++
+		}
+	case task.Status == database.TaskStatusInProgress && (state == 0 || state == asynq.TaskStateArchived || state == asynq.TaskStateCompleted):
+		reason := fmt.Sprintf("timed out according to the reconciler, the task ran for more than %d seconds and the queue no longer holds it", task.Timeout)
+
+		changed, err = reconciler.db.FailStuckTask(ctx, task.ID, task.Status, database.TaskStatusTimedOut, reason)
+		if err != nil {
+			return err
+		}
+
+		if changed {
+			stats.Failed++
+		}
+	default:
+		// pending, scheduled, being retried or still running, the queue
+		// will get to it
+		stats.Healthy++
+	}
+
+	return nil
+}
@@ -2,9 +2,13 @@ package worker
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 
+	"github.com/Babatunde50/distributask/internal/database"
 	"github.com/hibiken/asynq"
 )
 
@@ -25,9 +29,9 @@ func (distributor *RedisTaskDistributor) DistributeTaskSendTask(
 		return fmt.Errorf("failed to marshal task payload: %w", err)
 	}
 
-	task := asynq.NewTask(TaskSendTask, jsonPayload, opts[0])
+	task := asynq.NewTask(TaskSendTask, jsonPayload, opts...)
 
-	_, err = distributor.client.Enqueue(task, opts[1])
+	_, err = distributor.client.EnqueueContext(ctx, task)
 	if err != nil {
 		return fmt.Errorf("failed to enqueue task: %w", err)
 	}
@@ -35,36 +39,84 @@ func (distributor *RedisTaskDistributor) DistributeTaskSendTask(
 	return nil
 }
 
-func (processor *RedisTaskProcessor) ProcessTaskSendTask(ctx context.Context, task *asynq.Task) error {
+// NewSendTaskMessage returns the outbox message that has task processed once
+// the transaction creating it commits.
+func NewSendTaskMessage(task *database.Task) (*database.OutboxMessage, error) {
+	jsonPayload, err := json.Marshal(&PayloadSendTask{TaskID: task.ID, UserID: task.UserId})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal task payload: %w", err)
+	}
+
+	return &database.OutboxMessage{
+		Key:      database.TaskMessageKey(task.ID),
+		Type:     TaskSendTask,
+		Payload:  jsonPayload,
+		Queue:    QueueForPriority(task.Priority),
+		Group:    userGroup(task.UserId),
+		MaxRetry: task.MaxRetries,
+		Timeout:  task.Timeout,
+	}, nil
+}
+
+func (processor *baseProcessor) ProcessTaskSendTask(ctx context.Context, task *asynq.Task) error {
 	var payload PayloadSendTask
 	if err := json.Unmarshal(task.Payload(), &payload); err != nil {
 		return fmt.Errorf("failed to unmarshal payload: %w", asynq.SkipRetry)
 	}
 
 	// get task
-	gottenTask, err := processor.db.GetTask(payload.TaskID, payload.UserID)
+	gottenTask, err := processor.tasks.GetTask(ctx, payload.TaskID, payload.UserID)
 
 	if err != nil {
-		return fmt.Errorf("failed to get task from the db %v", err)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("task %d no longer exists: %w", payload.TaskID, asynq.SkipRetry)
+		}
+		return fmt.Errorf("failed to get task from the db: %w", err)
 	}
 
-	gottenTask.Status = "in_progress"
+	// the outbox delivers at least once, so the same task may arrive again
+	// after it was processed
+	if gottenTask.Status == database.TaskStatusCompleted {
+		log.Printf("Skipping task %d, it is already completed", gottenTask.ID)
+		return nil
+	}
 
-	fmt.Println(gottenTask.UserId, "gottenTask.UserId")
+	retried, _ := retryCount(ctx)
+	attempt := database.TaskAttempt{Worker: processor.name, Attempt: retried}
 
-	err = processor.db.UpdateTask(gottenTask)
+	err = processor.tasks.MarkStarted(ctx, gottenTask, attempt)
 
 	if err != nil {
-		return fmt.Errorf("failed to update task from the db %v", err)
+		if errors.Is(err, database.ErrInvalidTransition) {
+			return fmt.Errorf("failed to start task %d: %v: %w", gottenTask.ID, err, asynq.SkipRetry)
+		}
+		return fmt.Errorf("failed to start task %d: %w", gottenTask.ID, err)
 	}
 
+	progress := newProgressReporter(processor.tasks, gottenTask.ID)
+
 	switch gottenTask.Type {
 	case "image_processing":
-		err := imageHandler(processor.db, gottenTask)
+		err := imageHandler(ctx, processor.tasks, processor.storage, processor.fetcher, progress, gottenTask)
 		if err != nil {
 			return err
 		}
 	}
 
+	err = processor.tasks.MarkCompleted(ctx, gottenTask, attempt)
+
+	if err != nil {
+		// somebody else, such as the reconciler, gave up on the task while
+		// it ran, so there's nothing to retry
+		if errors.Is(err, database.ErrEditConflict) || errors.Is(err, database.ErrInvalidTransition) {
+			return fmt.Errorf("failed to complete task %d: %v: %w", gottenTask.ID, err, asynq.SkipRetry)
+		}
+		return fmt.Errorf("failed to complete task %d: %w", gottenTask.ID, err)
+	}
+
+	// only now that it is, so a task that fails to complete never shows
+	// as completed
+	progress.Report(ctx, 100, PhaseCompleted)
+
 	return nil
 }